@@ -1,23 +1,95 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/timsolov/fragmented-tcp/conf"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
 	"github.com/timsolov/fragmented-tcp/server"
+	"github.com/timsolov/fragmented-tcp/wal"
 )
 
 var (
 	bindAddr string
+	codec    string
+
+	unixSocket               string
+	tlsAddr, tlsCert, tlsKey string
+
+	connRate, acceptRate   float64
+	connBurst, acceptBurst int
+	rateLimitedDisconnect  int
+
+	maxConns, maxUnauthConns int
+	maxMsgLength             int
+	hiTimeout                time.Duration
+	awayTimeout              time.Duration
+	historySize              int
+	historyPairs             int
+	historyTTL               time.Duration
+	historyGrace             time.Duration
+
+	walDir         string
+	walSegmentSize int64
+	walMaxSegments int
+	walSync        time.Duration
+	walEvents      bool
+
+	metricsAddr string
+	adminAddr   string
+	wsAddr      string
+	wsOrigins   string
+	clusterAddr string
+	peers       string
+
+	writeTimeout    time.Duration
+	shutdownTimeout time.Duration
 )
 
 // init function will run automatically on application startups so we don't need to call it from anywhere.
 // also this logic can be implemented by cobra package but it's not necessary for that little project.
 func init() {
 	flag.StringVar(&bindAddr, "bindAddr", ":2000", "Bind addr for listening connections on.")
+	flag.StringVar(&unixSocket, "unixSocket", "", "Path of Unix domain socket for listening connections on, empty - disabled.")
+	flag.StringVar(&tlsAddr, "tlsAddr", "", "Bind addr for listening TLS connections on, empty - disabled.")
+	flag.StringVar(&tlsCert, "tlsCert", "", "Path of PEM encoded certificate for TLS listener.")
+	flag.StringVar(&tlsKey, "tlsKey", "", "Path of PEM encoded private key for TLS listener.")
+	flag.StringVar(&codec, "codec", "", "Codec of high level protocol: text or json. Negotiated per connection when empty.")
+	flag.Float64Var(&connRate, "connRate", 0, "Commands per second allowed for each connection, 0 - unlimited.")
+	flag.IntVar(&connBurst, "connBurst", 10, "Burst of commands allowed for each connection.")
+	flag.Float64Var(&acceptRate, "acceptRate", 0, "New connections per second allowed for each source IP, 0 - unlimited.")
+	flag.IntVar(&acceptBurst, "acceptBurst", 10, "Burst of new connections allowed for each source IP.")
+	flag.IntVar(&rateLimitedDisconnect, "rateLimitedDisconnect", 0, "Disconnect client after this amount of rate limited commands within a minute, 0 - never.")
+	flag.IntVar(&maxConns, "maxConns", 0, "Max amount of concurrent connections, 0 - unlimited.")
+	flag.IntVar(&maxUnauthConns, "maxUnauthConns", 0, "Max amount of concurrent connections which didn't send HI, 0 - unlimited.")
+	flag.IntVar(&maxMsgLength, "maxMsgLength", 0, "Max amount of characters in text of MSG, 0 - unlimited.")
+	flag.DurationVar(&hiTimeout, "hiTimeout", 0, "Duration after connection during which client should send HI, 0 - unlimited.")
+	flag.DurationVar(&awayTimeout, "awayTimeout", 0, "Idle duration after which online client is shown as away, 0 - disabled.")
+	flag.IntVar(&historySize, "historySize", 0, "Amount of messages kept per pair of clients for HISTORY, 0 - history is disabled unless historyTTL is set.")
+	flag.IntVar(&historyPairs, "historyPairs", server.DefaultHistoryPairs, "Max amount of pairs of clients which messages are kept for HISTORY, the least recently active pair is dropped first.")
+	flag.DurationVar(&historyTTL, "historyTTL", 0, "Duration messages are kept for HISTORY, 0 - unlimited.")
+	flag.DurationVar(&historyGrace, "historyGrace", server.DefaultHistoryGrace, "Duration history of disconnected client is kept for it to reconnect and take its name again, 0 - till messages expire.")
+	flag.StringVar(&walDir, "walDir", "", "Directory of write-ahead log of delivered messages, empty - disabled. History is restored from it on start.")
+	flag.Int64Var(&walSegmentSize, "walSegmentSize", wal.DefaultSegmentSize, "Max size of segment file of write-ahead log in bytes.")
+	flag.IntVar(&walMaxSegments, "walMaxSegments", 0, "Max amount of segment files of write-ahead log, the oldest ones are removed, 0 - unlimited.")
+	flag.DurationVar(&walSync, "walSync", time.Second, "Period of fsync of write-ahead log, 0 - after every record, negative - on rotation of segment only.")
+	flag.BoolVar(&walEvents, "walEvents", false, "Append taking and releasing of names by clients to write-ahead log.")
+	flag.StringVar(&metricsAddr, "metricsAddr", "", "Bind addr of HTTP listener exposing Prometheus metrics on /metrics, empty - disabled.")
+	flag.StringVar(&adminAddr, "adminAddr", "", "Bind addr of admin HTTP API, empty - disabled. Token is read from ADMIN_TOKEN env.")
+	flag.StringVar(&wsAddr, "wsAddr", "", "Bind addr of WebSocket gateway for browsers, empty - disabled.")
+	flag.StringVar(&wsOrigins, "wsOrigins", "", "Comma separated origins of pages allowed to connect WebSocket gateway, e.g. https://example.com, empty - any.")
+	flag.StringVar(&clusterAddr, "clusterAddr", "", "Bind addr of peer link listener of cluster, empty - cluster mode is disabled. Secret shared by nodes is read from CLUSTER_SECRET env.")
+	flag.StringVar(&peers, "peers", "", "Comma separated addresses of peer link listeners of other nodes of cluster.")
+	flag.DurationVar(&writeTimeout, "writeTimeout", time.Second*10, "Time given to write each packet to client, the client is disconnected after it, 0 - unlimited.")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", time.Second*10, "Time given to clients to receive pending messages on shutdown.")
 	flag.Parse()
 }
 
@@ -26,12 +98,145 @@ func main() {
 
 	log := config.LOG()
 
-	srv := server.NewServer(bindAddr, log)
+	var opts []server.ServerOpt
+	switch codec {
+	case "":
+	case "text":
+		opts = append(opts, server.Codec(highproto.Text))
+	case "json":
+		opts = append(opts, server.Codec(highproto.JSON))
+	default:
+		log.Fatalf("unknown codec %s", codec)
+	}
+
+	opts = append(opts,
+		server.ConnRateLimit(connRate, connBurst),
+		server.AcceptRateLimit(acceptRate, acceptBurst),
+		server.DisconnectRateLimited(rateLimitedDisconnect),
+		server.MaxConns(maxConns),
+		server.MaxUnauthConns(maxUnauthConns),
+		server.HiTimeout(hiTimeout),
+		server.AwayTimeout(awayTimeout),
+		server.MetricsAddr(metricsAddr),
+		server.AdminAddr(adminAddr, os.Getenv("ADMIN_TOKEN")),
+		server.WebSocketAddr(wsAddr),
+		server.WriteTimeout(writeTimeout),
+		server.ShutdownTimeout(shutdownTimeout),
+	)
+	if wsOrigins != "" {
+		opts = append(opts, server.WebSocketOrigins(strings.Split(wsOrigins, ",")...))
+	}
+	if maxMsgLength > 0 {
+		opts = append(opts, server.Interceptors(server.MaxMsgLength(maxMsgLength)))
+	}
+	if historySize > 0 || historyTTL > 0 {
+		history := server.NewMemHistory(historySize, historyTTL, historyPairs)
+		if walDir != "" {
+			n, names, err := server.RestoreHistory(history, walDir)
+			if err != nil {
+				log.WithError(err).Fatal("restore history from write-ahead log")
+			}
+			log.Infof("%d messages are restored from write-ahead log", n)
+			opts = append(opts, server.ReleasedNames(names...))
+		}
+		opts = append(opts, server.MessageHistory(history), server.HistoryGrace(historyGrace))
+	}
+	if walDir != "" {
+		wl, err := wal.Open(walDir, wal.SegmentSize(walSegmentSize), wal.MaxSegments(walMaxSegments), wal.SyncInterval(walSync))
+		if err != nil {
+			log.WithError(err).Fatal("open write-ahead log")
+		}
+		defer func() {
+			if err := wl.Close(); err != nil {
+				log.WithError(err).Error("close write-ahead log")
+			}
+		}()
+		opts = append(opts, server.WriteAheadLog(wl, walEvents))
+	}
+	if clusterAddr != "" {
+		var peerAddrs []string
+		if peers != "" {
+			peerAddrs = strings.Split(peers, ",")
+		}
+		opts = append(opts,
+			server.Cluster(clusterAddr, peerAddrs...),
+			server.ClusterSecret(os.Getenv("CLUSTER_SECRET")),
+		)
+	}
+
+	l, err := listen(bindAddr)
+	if err != nil {
+		log.WithError(err).Fatalf("listen tcp server on %s", bindAddr)
+	}
+
+	var tlsConfig *tls.Config
+	if tlsAddr != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			log.WithError(err).Fatal("load TLS certificate")
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	// additional listeners aren't passed on upgrade, they are opened by every process
+	listenMore := func(srv *server.Server) {
+		if unixSocket != "" {
+			ul, err := net.Listen("unix", unixSocket)
+			if err != nil {
+				log.WithError(err).Fatalf("listen unix socket %s", unixSocket)
+			}
+			srv.Serve(ul)
+			log.Infof("the server is running on %s", unixSocket)
+		}
+		if tlsConfig != nil {
+			tl, err := tls.Listen("tcp", tlsAddr, tlsConfig)
+			if err != nil {
+				log.WithError(err).Fatalf("listen tls server on %s", tlsAddr)
+			}
+			srv.Serve(tl)
+			log.Infof("the TLS server is running on %s", tl.Addr())
+		}
+	}
+
+	newServer := func(l net.Listener) *server.Server {
+		srv := server.NewServerFromListener(l, log, opts...)
+		log.Infof("the server is running on %s", l.Addr())
+		listenMore(srv)
+		ready()
+		return srv
+	}
+
+	srv := newServer(l)
 	defer srv.Stop()
-	log.Infof("the server is running on %s", bindAddr)
 
-	// wait for interruption
+	// wait for interruption or upgrade
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
-	<-interrupt
+	upgradeSignal := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeSignal, upgradeSignals...)
+	}
+
+	for {
+		select {
+		case <-interrupt:
+			log.Info("the server is shutting down")
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := srv.StopGracefully(ctx); err != nil {
+				log.WithError(err).Warn("connections were closed forcibly")
+			}
+			return
+		case <-upgradeSignal:
+			log.Info("the server is upgrading")
+			if err = upgrade(srv, listenMore, log); err != nil {
+				log.WithError(err).Error("upgrade failed")
+				continue
+			}
+			log.Info("the listener is passed to the new process")
+			return
+		case <-srv.Done(): // stopped by SHUTDOWN command
+			return
+		}
+	}
 }
@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/timsolov/fragmented-tcp/server"
+)
+
+// upgradeSignals are signals which trigger upgrade, there are no ones on this platform
+var upgradeSignals []os.Signal
+
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func ready() {}
+
+func upgrade(srv *server.Server, listenMore func(*server.Server), log *logrus.Entry) error {
+	return errors.New("upgrade isn't supported on this platform")
+}
@@ -0,0 +1,144 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/timsolov/fragmented-tcp/server"
+)
+
+// environment variables with descriptors passed by parent process to the new one on upgrade
+const (
+	listenerFDEnv = "FRAGMENTED_TCP_LISTENER_FD"
+	readyFDEnv    = "FRAGMENTED_TCP_READY_FD"
+)
+
+// upgradeSignals are signals which trigger upgrade, SIGHUP isn't one of them
+// so hangup of terminal doesn't start the new process
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// readyTimeout is a time given to the new process to start accepting connections
+const readyTimeout = time.Second * 10
+
+// listen returns listener inherited from parent process or creates the new one.
+func listen(addr string) (net.Listener, error) {
+	fd, ok := os.LookupEnv(listenerFDEnv)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(listenerFDEnv)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", listenerFDEnv)
+	}
+
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close() // FileListener duplicates descriptor
+
+	return net.FileListener(f)
+}
+
+// ready notifies parent process that the server is accepting connections.
+func ready() {
+	fd, ok := os.LookupEnv(readyFDEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+
+	if n, err := strconv.Atoi(fd); err == nil {
+		f := os.NewFile(uintptr(n), "ready")
+		f.Write([]byte{1})
+		f.Close()
+	}
+}
+
+// upgrade passes listening socket to the new process of the same binary.
+// The server pauses accepting connections first, so the new process can bind addresses of additional
+// listeners, while connections coming meanwhile wait in socket's backlog. The server is stopped
+// gracefully only when the new process is ready, so connected clients are served till then.
+// If the new process fails to start, the server resumes accepting on the same socket and additional
+// listeners are opened again by listenMore, so connected clients aren't affected.
+func upgrade(srv *server.Server, listenMore func(*server.Server), log *logrus.Entry) error {
+	tl, ok := srv.Listener().(*net.TCPListener)
+	if !ok {
+		return errors.New("listener isn't a TCP listener")
+	}
+
+	// the descriptor is duplicated so it remains open after the server closes its listener
+	lf, err := tl.File()
+	if err != nil {
+		return errors.Wrap(err, "get listener descriptor")
+	}
+	defer lf.Close()
+
+	srv.PauseAccepting()
+	if err := spawn(lf, log); err != nil {
+		l, lerr := net.FileListener(lf)
+		if lerr != nil {
+			log.WithError(lerr).Fatal("restore listener")
+		}
+		if rerr := srv.ResumeAccepting(l); rerr != nil {
+			log.WithError(rerr).Fatal("resume accepting")
+		}
+		listenMore(srv)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.StopGracefully(ctx); err != nil {
+		log.WithError(err).Warn("connections were closed forcibly")
+	}
+	return nil
+}
+
+// spawn starts the new process passing listener descriptor and waits till it's ready.
+func spawn(lf *os.File, log *logrus.Entry) error {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create ready pipe")
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return errors.Wrap(err, "find executable")
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lf, readyW} // descriptors 3 and 4 in the new process
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenerFDEnv, 3),
+		fmt.Sprintf("%s=%d", readyFDEnv, 4),
+	)
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return errors.Wrap(err, "start new process")
+	}
+	log.WithField("pid", cmd.Process.Pid).Info("new process is started")
+
+	readyR.SetReadDeadline(time.Now().Add(readyTimeout))
+	if _, err = readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.Wrap(err, "wait for new process")
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Command wal prints records of write-ahead log of the server.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/timsolov/fragmented-tcp/wal"
+)
+
+var (
+	dir     string
+	follow  bool
+	asJSON  bool
+	msgOnly bool
+)
+
+func init() {
+	flag.StringVar(&dir, "dir", "", "Directory of write-ahead log.")
+	flag.BoolVar(&follow, "follow", false, "Wait for new records after the end of log like tail -f.")
+	flag.BoolVar(&asJSON, "json", false, "Print records as JSON objects, one per line.")
+	flag.BoolVar(&msgOnly, "msg", false, "Print MSG records only.")
+	flag.Parse()
+}
+
+func main() {
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "-dir is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	print := func(r wal.Record) error {
+		if msgOnly && r.Type != wal.RecordMsg {
+			return nil
+		}
+		if asJSON {
+			return enc.Encode(r)
+		}
+
+		var err error
+		ts := r.Time.Format(time.RFC3339Nano)
+		switch r.Type {
+		case wal.RecordMsg:
+			_, err = fmt.Printf("%s MSG %d %s -> %s: %s\n", ts, r.ID, r.From, r.To, r.Text)
+		default:
+			_, err = fmt.Printf("%s %s %s\n", ts, r.Type, r.Name)
+		}
+		return err
+	}
+
+	var err error
+	if follow {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if err = wal.Follow(ctx, dir, print); err == context.Canceled {
+			err = nil
+		}
+	} else {
+		err = wal.Read(dir, print)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/timsolov/fragmented-tcp
 
-go 1.17
+go 1.18
 
 require (
 	github.com/caarlos0/env v3.5.0+incompatible
@@ -0,0 +1,363 @@
+// Package metrics implements a minimal registry of metrics exposed in Prometheus text format.
+// It doesn't depend on Prometheus client so the server can be scraped without extra services.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are default buckets of histograms in seconds
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// collector writes its series in text format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry keeps metrics and exposes them.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates new Registry instance
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes all metrics in Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP implementation of http.Handler interface
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc describes metric and its labels
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escape(d.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key joins label values to use it as a key of series
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs builds {label="value",...} part of series, extra pair is appended when it isn't empty.
+func (d desc) labelPairs(key string, extraName, extraValue string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escape(v, true)+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns keys of series stored in the map sorted
+func sortedKeys(m *sync.Map) []string {
+	var keys []string
+	m.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// value is a float updated atomically, so series don't share a lock
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		if atomic.CompareAndSwapUint64(&v.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// values is a set of float series by label values.
+// Existing series are looked up without locking and updated atomically.
+type values struct {
+	desc
+	series sync.Map // key -> *value
+}
+
+// with returns series of the label values creating it if it's missing
+func (v *values) with(labelValues []string) *value {
+	k := v.key(labelValues)
+	if s, ok := v.series.Load(k); ok {
+		return s.(*value)
+	}
+	s, _ := v.series.LoadOrStore(k, &value{})
+	return s.(*value)
+}
+
+func (v *values) write(w *bufio.Writer) {
+	v.header(w)
+	for _, k := range sortedKeys(&v.series) {
+		s, _ := v.series.Load(k)
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(k, "", ""), formatFloat(s.(*value).get()))
+	}
+}
+
+// Counter is a monotonically increasing metric.
+type Counter struct {
+	values
+}
+
+// NewCounter registers new counter with given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{values{desc: desc{name: name, help: help, typ: "counter", labels: labels}}}
+	r.register(c)
+	return c
+}
+
+// Inc increments counter of series with given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.with(labelValues).add(1)
+}
+
+// Add adds non-negative value to counter of series with given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter can't decrease")
+	}
+	c.with(labelValues).add(v)
+}
+
+// Value returns current value of series with given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.with(labelValues).get()
+}
+
+// With returns series with given label values, it can be kept to update the series without lookup.
+func (c *Counter) With(labelValues ...string) *CounterSeries {
+	return &CounterSeries{v: c.with(labelValues)}
+}
+
+// CounterSeries is a series of counter with fixed label values.
+type CounterSeries struct {
+	v *value
+}
+
+// Inc increments the series.
+func (c *CounterSeries) Inc() {
+	c.v.add(1)
+}
+
+// Add adds non-negative value to the series.
+func (c *CounterSeries) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter can't decrease")
+	}
+	c.v.add(v)
+}
+
+// Value returns current value of the series.
+func (c *CounterSeries) Value() float64 {
+	return c.v.get()
+}
+
+// Gauge is a metric which can go up and down.
+type Gauge struct {
+	values
+}
+
+// NewGauge registers new gauge with given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{values{desc: desc{name: name, help: help, typ: "gauge", labels: labels}}}
+	r.register(g)
+	return g
+}
+
+// Set sets value of series with given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.with(labelValues).set(v)
+}
+
+// Add adds value to series with given label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.with(labelValues).add(v)
+}
+
+// Value returns current value of series with given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.with(labelValues).get()
+}
+
+// gaugeFunc is a gauge which value is calculated on each scrape.
+type gaugeFunc struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc registers gauge without labels which value is returned by f on each scrape.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&gaugeFunc{desc: desc{name: name, help: help, typ: "gauge"}, f: f})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// Histogram counts observations in configurable buckets.
+// Existing series are looked up without locking and updated atomically.
+type Histogram struct {
+	desc
+	buckets []float64
+	series  sync.Map // key -> *HistogramSeries
+}
+
+// HistogramSeries is a series of histogram with fixed label values.
+type HistogramSeries struct {
+	count   uint64 // first to be aligned for atomic operations
+	sum     value
+	buckets []float64
+	counts  []uint64 // count of observations per bucket, not cumulative
+}
+
+// NewHistogram registers new histogram with given upper bounds of buckets and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds observation to series with given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.With(labelValues...).Observe(v)
+}
+
+// With returns series with given label values, it can be kept to update the series without lookup.
+func (h *Histogram) With(labelValues ...string) *HistogramSeries {
+	k := h.key(labelValues)
+	if s, ok := h.series.Load(k); ok {
+		return s.(*HistogramSeries)
+	}
+	s, _ := h.series.LoadOrStore(k, &HistogramSeries{buckets: h.buckets, counts: make([]uint64, len(h.buckets))})
+	return s.(*HistogramSeries)
+}
+
+// Observe adds observation to the series.
+func (s *HistogramSeries) Observe(v float64) {
+	if i := sort.SearchFloat64s(s.buckets, v); i < len(s.buckets) {
+		atomic.AddUint64(&s.counts[i], 1)
+	}
+	s.sum.add(v)
+	atomic.AddUint64(&s.count, 1)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+
+	for _, k := range sortedKeys(&h.series) {
+		v, _ := h.series.Load(k)
+		s := v.(*HistogramSeries)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += atomic.LoadUint64(&s.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(k, "le", formatFloat(upper)), cumulative)
+		}
+		// observations may be added meanwhile, +Inf bucket isn't less than the rest ones
+		count := atomic.LoadUint64(&s.count)
+		if count < cumulative {
+			count = cumulative
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(k, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(k, "", ""), formatFloat(s.sum.get()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(k, "", ""), count)
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	packets := r.NewCounter("packets_total", "Packets by direction.", "direction")
+	packets.Inc("in")
+	packets.Add(2, "out")
+	packets.Inc("in")
+
+	clients := r.NewGauge("clients", "Connected clients.")
+	clients.Set(3)
+	clients.Add(-1)
+
+	r.NewGaugeFunc("queue_depth", "Queue depth.", func() float64 { return 7 })
+
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "command")
+	latency.Observe(0.05, "HI")
+	latency.Observe(0.5, "HI")
+	latency.Observe(5, "HI")
+
+	var b bytes.Buffer
+	_, err := r.WriteTo(&b)
+	assert.NoError(t, err)
+
+	assert.Equal(t, `# HELP packets_total Packets by direction.
+# TYPE packets_total counter
+packets_total{direction="in"} 2
+packets_total{direction="out"} 2
+# HELP clients Connected clients.
+# TYPE clients gauge
+clients 2
+# HELP queue_depth Queue depth.
+# TYPE queue_depth gauge
+queue_depth 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{command="HI",le="0.1"} 1
+latency_seconds_bucket{command="HI",le="1"} 2
+latency_seconds_bucket{command="HI",le="+Inf"} 3
+latency_seconds_sum{command="HI"} 5.55
+latency_seconds_count{command="HI"} 3
+`, b.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("errors_total", "Errors.", "error").Inc("bad \"packet\"\n")
+
+	var b bytes.Buffer
+	r.WriteTo(&b)
+
+	assert.Contains(t, b.String(), `errors_total{error="bad \"packet\"\n"} 1`)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	packets := r.NewCounter("packets_total", "Packets.", "command")
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{1}, "command")
+	series := packets.With("MSG")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				series.Inc()
+				packets.Add(0.5, "HI")
+				latency.Observe(0.5, "MSG")
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, float64(8000), packets.Value("MSG"))
+	assert.Equal(t, float64(4000), packets.Value("HI"))
+
+	var b bytes.Buffer
+	r.WriteTo(&b)
+	assert.Contains(t, b.String(), `latency_seconds_bucket{command="MSG",le="1"} 8000`)
+	assert.Contains(t, b.String(), `latency_seconds_sum{command="MSG"} 4000`)
+}
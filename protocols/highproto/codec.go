@@ -0,0 +1,181 @@
+package highproto
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Codec encodes and decodes messages of high level protocol.
+// The server uses one codec per connection so clients may choose the wire format they prefer.
+// Unmarshal(Marshal(m)) == m for any message which Marshal accepts with two exceptions:
+// Text doesn't carry direction of MSG, so Msg{From} is decoded as Msg{To},
+// and JSON replaces every byte of invalid UTF-8 sequences in strings by U+FFFD.
+type Codec interface {
+	// Marshal encodes message into packet.
+	Marshal(m Message) ([]byte, error)
+	// Unmarshal decodes packet into message.
+	Unmarshal(packet []byte) (Message, error)
+}
+
+// Predefined codecs
+var (
+	Text Codec = textCodec{}
+	JSON Codec = jsonCodec{}
+)
+
+// Detect chooses codec by the first packet received from client.
+// JSON packets always start with '{' which is never a valid text command.
+func Detect(packet []byte) Codec {
+	if trimmed := bytes.TrimLeft(packet, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return JSON
+	}
+	return Text
+}
+
+// textCodec is a space-delimited format described in README.
+type textCodec struct{}
+
+func (textCodec) Marshal(m Message) ([]byte, error) {
+	if err := validate(m); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(Name(m))
+	for _, param := range m.Params() {
+		b.WriteByte(Delimiter)
+		b.WriteString(param)
+	}
+	return b.Bytes(), nil
+}
+
+func (textCodec) Unmarshal(packet []byte) (Message, error) {
+	kind, params, err := Parse(packet)
+	if err == ErrUnknownPacket { // the first octet isn't a command of the protocol
+		return parseCommand(packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newMessage(kind, params)
+}
+
+// jsonMessage is a union of all fields used by JSON codec.
+type jsonMessage struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name,omitempty"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Text    string   `json:"text,omitempty"`
+	Param   string   `json:"param,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	State   string   `json:"state,omitempty"`
+	Verbose bool     `json:"verbose,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Offset  int      `json:"offset,omitempty"`
+	Token   string   `json:"token,omitempty"`
+	Limit   int      `json:"limit,omitempty"`
+	ID      uint64   `json:"id,omitempty"`
+	SinceID uint64   `json:"since_id,omitempty"`
+	Time    int64    `json:"time,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// jsonCodec is a JSON format: one JSON object per packet with "type" field
+// containing the same command names as text format.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(m Message) ([]byte, error) {
+	if err := validate(m); err != nil {
+		return nil, err
+	}
+
+	jm := jsonMessage{Type: Name(m)}
+	switch m := m.(type) {
+	case Hi:
+		jm.Name = m.Name
+	case Clients:
+		jm.Verbose, jm.Prefix, jm.Offset, jm.Token, jm.Limit = m.Verbose, m.Prefix, m.Offset, m.Token, m.Limit
+	case Msg:
+		jm.From, jm.To, jm.Text = m.From, m.To, m.Text
+	case Ok:
+		jm.Param = m.Param
+	case Error:
+		jm.Reason = m.Reason
+	case Block:
+		jm.Name = m.Name
+	case Unblock:
+		jm.Name = m.Name
+	case Watch:
+		jm.Name = m.Name
+	case Unwatch:
+		jm.Name = m.Name
+	case Status:
+		jm.State, jm.Text = m.State, m.Text
+	case History:
+		jm.Name, jm.SinceID, jm.Limit = m.Name, m.SinceID, m.Limit
+	case Entry:
+		jm.ID, jm.Time, jm.From, jm.Text = m.ID, m.Time, m.From, m.Text
+	case Command:
+		jm.Args = m.Args
+	}
+
+	return json.Marshal(jm)
+}
+
+func (jsonCodec) Unmarshal(packet []byte) (Message, error) {
+	var jm jsonMessage
+	if err := json.Unmarshal(packet, &jm); err != nil {
+		return nil, errors.Wrap(ErrUnknownPacket, err.Error())
+	}
+
+	var m Message
+	switch jm.Type {
+	case "HI":
+		m = Hi{Name: jm.Name}
+	case "CLIENTS":
+		m = Clients{Verbose: jm.Verbose, Prefix: jm.Prefix, Offset: jm.Offset, Token: jm.Token, Limit: jm.Limit}
+	case "MSG":
+		m = Msg{From: jm.From, To: jm.To, Text: jm.Text}
+	case "PING":
+		m = Ping{}
+	case "PONG":
+		m = Pong{}
+	case "OK":
+		m = Ok{Param: jm.Param}
+	case "ERROR":
+		m = Error{Reason: jm.Reason}
+	case "BLOCK":
+		m = Block{Name: jm.Name}
+	case "UNBLOCK":
+		m = Unblock{Name: jm.Name}
+	case "HIDE":
+		m = Hide{}
+	case "UNHIDE":
+		m = Unhide{}
+	case "WATCH":
+		m = Watch{Name: jm.Name}
+	case "UNWATCH":
+		m = Unwatch{Name: jm.Name}
+	case "STATUS":
+		m = Status{State: jm.State, Text: jm.Text}
+	case "HISTORY":
+		m = History{Name: jm.Name, SinceID: jm.SinceID, Limit: jm.Limit}
+	case "ENTRY":
+		m = Entry{ID: jm.ID, Time: jm.Time, From: jm.From, Text: jm.Text}
+	default:
+		c := Command{Name: jm.Type, Args: jm.Args}
+		if err := validateCommand(c); err != nil {
+			return nil, errors.Wrap(ErrUnknownPacket, err.Error())
+		}
+		m = c
+	}
+
+	if err := validate(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
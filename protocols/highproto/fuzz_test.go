@@ -0,0 +1,158 @@
+package highproto
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fuzzMessage builds message of any kind from fuzzed values.
+func fuzzMessage(kind byte, a, b string) Message {
+	switch MessageKind(kind % byte(lastKind+2)) {
+	case HI:
+		return Hi{Name: a}
+	case CLIENTS:
+		c := Clients{Verbose: len(b)%2 == 1, Prefix: a, Limit: len(b)}
+		if strings.HasPrefix(b, TokenPrefix) {
+			c.Token = b
+		} else {
+			c.Offset = len(a)
+		}
+		return c
+	case MSG:
+		return Msg{To: a, Text: b}
+	case PONG:
+		return Pong{}
+	case PING:
+		return Ping{}
+	case OK:
+		return Ok{Param: a}
+	case ERROR:
+		return Error{Reason: a}
+	case BLOCK:
+		return Block{Name: a}
+	case UNBLOCK:
+		return Unblock{Name: a}
+	case HIDE:
+		return Hide{}
+	case UNHIDE:
+		return Unhide{}
+	case WATCH:
+		return Watch{Name: a}
+	case UNWATCH:
+		return Unwatch{Name: a}
+	case STATUS:
+		return Status{State: a, Text: b}
+	case HISTORY:
+		return History{Name: a, SinceID: uint64(len(b)), Limit: len(a)}
+	case ENTRY:
+		return Entry{ID: uint64(len(a)), Time: int64(len(b)) - 1, From: a, Text: b}
+	case lastKind + 1:
+		c := Command{Name: a}
+		if b != "" {
+			c.Args = strings.Split(b, " ")
+		}
+		return c
+	}
+	return Msg{From: a, Text: b}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add(byte(HI), "Tim", "")
+	f.Add(byte(MSG), "bob", "hello bob")
+	f.Add(byte(MSG), "bob", "invalid \xff\xfe UTF-8")
+	f.Add(byte(OK), "client1\nclient2", "")
+	f.Add(byte(ERROR), "HI required", "")
+	f.Add(byte(UNKNOWN), "alice", "hi there")
+	f.Add(byte(BLOCK), "bob", "")
+	f.Add(byte(CLIENTS), "al", "~YWxpY2U")
+	f.Add(byte(HISTORY), "bob", "")
+	f.Add(byte(ENTRY), "bob", "hello alice")
+	f.Add(byte(STATUS), "away", "back in 5 minutes")
+	f.Add(byte(lastKind+1), "WEATHER", "Moscow today")
+
+	f.Fuzz(func(t *testing.T, kind byte, a, b string) {
+		m := fuzzMessage(kind, a, b)
+
+		codecs := map[string]Codec{"text": Text, "json": JSON}
+		for name, codec := range codecs {
+			packet, err := codec.Marshal(m)
+			if err != nil {
+				continue
+			}
+			got, err := codec.Unmarshal(packet)
+			if err != nil {
+				t.Fatalf("%s: Unmarshal(%q) error = %v", name, packet, err)
+			}
+
+			want := m
+			if msg, ok := m.(Msg); ok && name == "text" && msg.From != "" {
+				want = Msg{To: msg.From, Text: msg.Text} // text format doesn't carry direction of MSG
+			}
+			if name == "json" {
+				want = replaceInvalidUTF8(want)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: Unmarshal(Marshal(%#v)) = %#v", name, m, got)
+			}
+		}
+	})
+}
+
+// replaceInvalidUTF8 returns copy of message with every byte of invalid UTF-8 sequences
+// in strings replaced by U+FFFD like JSON does.
+func replaceInvalidUTF8(m Message) Message {
+	fix := func(s string) string {
+		if utf8.ValidString(s) {
+			return s
+		}
+		var b strings.Builder
+		for _, r := range s { // invalid byte is decoded as RuneError
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+
+	v := reflect.New(reflect.TypeOf(m)).Elem()
+	v.Set(reflect.ValueOf(m))
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i); {
+		case f.Kind() == reflect.String:
+			f.SetString(fix(f.String()))
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String && !f.IsNil():
+			fixed := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			for j := 0; j < f.Len(); j++ {
+				fixed.Index(j).SetString(fix(f.Index(j).String()))
+			}
+			f.Set(fixed)
+		}
+	}
+	return v.Interface().(Message)
+}
+
+func FuzzParse(f *testing.F) {
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		kind, params, err := Parse(packet)
+		if err != nil {
+			if kind != UNKNOWN || params != nil {
+				t.Fatalf("Parse(%q) = %v, %q with error %v", packet, kind, params, err)
+			}
+			return
+		}
+
+		// octets joined back should give the same packet,
+		// commands without params ignore the rest of packet
+		rebuilt := kind.String()
+		for _, param := range params {
+			rebuilt += string(rune(Delimiter)) + param
+		}
+		if rebuilt != string(packet) && (len(params) > 0 || !bytes.HasPrefix(packet, []byte(rebuilt))) {
+			t.Fatalf("Parse(%q) = %v, %q", packet, kind, params)
+		}
+
+		// typed message must be built without panic
+		Unmarshal(packet)
+	})
+}
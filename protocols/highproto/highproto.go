@@ -2,7 +2,6 @@ package highproto
 
 import (
 	"bytes"
-	"fmt"
 
 	"github.com/pkg/errors"
 )
@@ -15,6 +14,20 @@ const (
 	CLIENTS
 	MSG
 	PONG
+	PING
+	OK
+	ERROR
+	BLOCK
+	UNBLOCK
+	HIDE
+	UNHIDE
+	WATCH
+	UNWATCH
+	STATUS
+	HISTORY
+	ENTRY
+
+	lastKind = ENTRY // the last command of the protocol
 )
 
 // String implementation of Stringer interface
@@ -26,6 +39,32 @@ func (k MessageKind) String() string {
 		return "CLIENTS"
 	case MSG:
 		return "MSG"
+	case PONG:
+		return "PONG"
+	case PING:
+		return "PING"
+	case OK:
+		return "OK"
+	case ERROR:
+		return "ERROR"
+	case BLOCK:
+		return "BLOCK"
+	case UNBLOCK:
+		return "UNBLOCK"
+	case HIDE:
+		return "HIDE"
+	case UNHIDE:
+		return "UNHIDE"
+	case WATCH:
+		return "WATCH"
+	case UNWATCH:
+		return "UNWATCH"
+	case STATUS:
+		return "STATUS"
+	case HISTORY:
+		return "HISTORY"
+	case ENTRY:
+		return "ENTRY"
 	}
 	return "UNKNOWN"
 }
@@ -36,8 +75,25 @@ const Delimiter = 0x20 // Space
 // SYSTEM reserved name for server's name
 const SYSTEM = "SYSTEM"
 
+// VerboseFlag is a parameter of CLIENTS requesting listing with statuses
+const VerboseFlag = "-v"
+
+// AnyPrefix is a prefix of CLIENTS matching all names, it's used when offset is passed without prefix
+const AnyPrefix = "*"
+
+// TokenPrefix starts continuation token passed as offset of CLIENTS
+const TokenPrefix = "~"
+
+// States of client set by STATUS
+const (
+	StateOnline = "online"
+	StateAway   = "away"
+	StateBusy   = "busy"
+)
+
 var (
 	ErrUnknownPacket = errors.New("unknown packet")
+	ErrBadParam      = errors.New("bad parameter")
 )
 
 // Parse parses byte packet and returns kind of message and parameters.
@@ -48,63 +104,86 @@ func Parse(packet []byte) (kind MessageKind, params []string, err error) {
 	}
 
 	octetsAmount := 1
+	optional := 0 // amount of trailing octets which could be omitted
 	switch string(parts[0]) {
 	case "HI":
 		kind = HI
 		octetsAmount = 2 // HI <NAME>
 	case "CLIENTS":
 		kind = CLIENTS
-		octetsAmount = 1 // CLIENTS
+		octetsAmount = 5 // CLIENTS [-v] [PREFIX] [OFFSET] [LIMIT]
+		optional = 4
 	case "MSG":
 		kind = MSG
 		octetsAmount = 3 // MSG <FROM> <TEXT>
 	case "PONG":
 		kind = PONG
 		octetsAmount = 1 // PONG
+	case "PING":
+		kind = PING
+		octetsAmount = 1 // PING
+	case "OK":
+		kind = OK
+		octetsAmount = 2 // OK <PARAMETER>
+	case "ERROR":
+		kind = ERROR
+		octetsAmount = 2 // ERROR <REASON>
+	case "BLOCK":
+		kind = BLOCK
+		octetsAmount = 2 // BLOCK <NAME>
+	case "UNBLOCK":
+		kind = UNBLOCK
+		octetsAmount = 2 // UNBLOCK <NAME>
+	case "HIDE":
+		kind = HIDE
+		octetsAmount = 1 // HIDE
+	case "UNHIDE":
+		kind = UNHIDE
+		octetsAmount = 1 // UNHIDE
+	case "WATCH":
+		kind = WATCH
+		octetsAmount = 2 // WATCH <NAME>
+	case "UNWATCH":
+		kind = UNWATCH
+		octetsAmount = 2 // UNWATCH <NAME>
+	case "STATUS":
+		kind = STATUS
+		octetsAmount = 3 // STATUS <STATE> [TEXT]
+		optional = 1
+	case "HISTORY":
+		kind = HISTORY
+		octetsAmount = 4 // HISTORY <NAME> [SINCE-ID] [LIMIT]
+		optional = 2
+	case "ENTRY":
+		kind = ENTRY
+		octetsAmount = 5 // ENTRY <ID> <TIME> <FROM> <TEXT>
 	default:
 		return UNKNOWN, nil, ErrUnknownPacket
 	}
 
 	if octetsAmount > 1 {
 		parts = bytes.SplitN(packet, []byte{Delimiter}, octetsAmount)
-		if len(parts) != octetsAmount {
+		if len(parts) < octetsAmount-optional {
 			return UNKNOWN, nil, errors.Wrap(ErrUnknownPacket, "split whole message")
 		}
 
-		params = make([]string, len(parts)-1)
-		for i := 1; i < len(parts); i++ {
-			params[i-1] = string(parts[i])
+		if len(parts) > 1 {
+			params = make([]string, len(parts)-1)
+			for i := 1; i < len(parts); i++ {
+				params[i-1] = string(parts[i])
+			}
 		}
 	}
 
 	return
 }
 
-type ResponseKind byte
-
-const (
-	OK ResponseKind = iota + 1
-	ERROR
-)
-
-// Response builds OK or ERROR response message.
-func Response(kind ResponseKind, param string) []byte {
-	switch kind {
-	case OK:
-		return []byte(fmt.Sprintf("OK %s", param))
-	case ERROR:
-		return []byte(fmt.Sprintf("ERROR %s", param))
-	}
-	return nil
+// Marshal encodes message in text format.
+func Marshal(m Message) ([]byte, error) {
+	return Text.Marshal(m)
 }
 
-// Msg builds MSG message.
-func Msg(from, text string) []byte {
-	var b bytes.Buffer
-	b.WriteString("MSG")
-	b.WriteByte(Delimiter)
-	b.WriteString(from)
-	b.WriteByte(Delimiter)
-	b.WriteString(text)
-	return b.Bytes()
+// Unmarshal decodes message in text format.
+func Unmarshal(packet []byte) (Message, error) {
+	return Text.Unmarshal(packet)
 }
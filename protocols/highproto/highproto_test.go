@@ -33,6 +33,59 @@ func TestParse(t *testing.T) {
 			wantKind: CLIENTS,
 			wantErr:  false,
 		},
+		{
+			name: "CLIENTS verbose",
+			args: args{
+				packet: []byte("CLIENTS -v"),
+			},
+			wantKind:   CLIENTS,
+			wantParams: []string{"-v"},
+			wantErr:    false,
+		},
+		{
+			name: "CLIENTS page",
+			args: args{
+				packet: []byte("CLIENTS -v al ~YWxpY2U 50"),
+			},
+			wantKind:   CLIENTS,
+			wantParams: []string{"-v", "al", "~YWxpY2U", "50"},
+			wantErr:    false,
+		},
+		{
+			name: "HISTORY",
+			args: args{
+				packet: []byte("HISTORY bob 42"),
+			},
+			wantKind:   HISTORY,
+			wantParams: []string{"bob", "42"},
+			wantErr:    false,
+		},
+		{
+			name: "STATUS",
+			args: args{
+				packet: []byte("STATUS away"),
+			},
+			wantKind:   STATUS,
+			wantParams: []string{"away"},
+			wantErr:    false,
+		},
+		{
+			name: "STATUS with text",
+			args: args{
+				packet: []byte("STATUS busy in a meeting"),
+			},
+			wantKind:   STATUS,
+			wantParams: []string{"busy", "in a meeting"},
+			wantErr:    false,
+		},
+		{
+			name: "STATUS without state",
+			args: args{
+				packet: []byte("STATUS"),
+			},
+			wantKind: UNKNOWN,
+			wantErr:  true,
+		},
 		// tests for other cases
 		// I can't write all tests because of time.
 	}
@@ -52,3 +105,129 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestJSON_Unmarshal(t *testing.T) {
+	type args struct {
+		packet []byte
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantMsg Message
+		wantErr bool
+	}{
+		{
+			name: "HI",
+			args: args{
+				packet: []byte(`{"type":"HI","name":"Tim"}`),
+			},
+			wantMsg: Hi{Name: "Tim"},
+			wantErr: false,
+		},
+		{
+			name: "MSG",
+			args: args{
+				packet: []byte(`{"type":"MSG","to":"bob","text":"hello bob"}`),
+			},
+			wantMsg: Msg{To: "bob", Text: "hello bob"},
+			wantErr: false,
+		},
+		{
+			name: "MSG without receiver",
+			args: args{
+				packet: []byte(`{"type":"MSG","text":"hello bob"}`),
+			},
+			wantErr: true,
+		},
+		{
+			name: "UNBLOCK",
+			args: args{
+				packet: []byte(`{"type":"UNBLOCK","name":"bob"}`),
+			},
+			wantMsg: Unblock{Name: "bob"},
+			wantErr: false,
+		},
+		{
+			name: "HI with control character",
+			args: args{
+				packet: []byte(`{"type":"HI","name":"a\tbusy\tfake\nmallory"}`),
+			},
+			wantErr: true,
+		},
+		{
+			name: "broken json",
+			args: args{
+				packet: []byte(`{"type":"HI"`),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMsg, err := JSON.Unmarshal(tt.args.packet)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("JSON.Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(gotMsg, tt.wantMsg) {
+				t.Errorf("JSON.Unmarshal() = %v, want %v", gotMsg, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     Message
+		want    string
+		wantErr bool
+	}{
+		{name: "OK", msg: Ok{Param: "Tim"}, want: "OK Tim"},
+		{name: "empty OK", msg: Ok{}, want: "OK "},
+		{name: "ERROR", msg: Error{Reason: "HI required"}, want: "ERROR HI required"},
+		{name: "MSG", msg: Msg{From: "Tim", Text: "hello bob"}, want: "MSG Tim hello bob"},
+		{name: "PING", msg: Ping{}, want: "PING"},
+		{name: "BLOCK", msg: Block{Name: "bob"}, want: "BLOCK bob"},
+		{name: "HIDE", msg: Hide{}, want: "HIDE"},
+		{name: "WATCH all", msg: Watch{Name: "*"}, want: "WATCH *"},
+		{name: "CLIENTS offset", msg: Clients{Offset: 10}, want: "CLIENTS * 10"},
+		{name: "CLIENTS page", msg: Clients{Verbose: true, Prefix: "al", Token: "~YWxpY2U", Limit: 50}, want: "CLIENTS -v al ~YWxpY2U 50"},
+		{name: "CLIENTS offset and token", msg: Clients{Offset: 10, Token: "~YWxpY2U"}, wantErr: true},
+		{name: "HISTORY", msg: History{Name: "bob", Limit: 10}, want: "HISTORY bob 0 10"},
+		{name: "ENTRY", msg: Entry{ID: 7, Time: 1700000000000, From: "bob", Text: "hello alice"}, want: "ENTRY 7 1700000000000 bob hello alice"},
+		{name: "BLOCK without name", msg: Block{}, wantErr: true},
+		{name: "name with delimiter", msg: Hi{Name: "T im"}, wantErr: true},
+		{name: "name with tab", msg: Hi{Name: "a\tbusy"}, wantErr: true},
+		{name: "name with new line", msg: Msg{To: "a\nmallory", Text: "hi"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Marshal() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("Marshal() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageKind_String(t *testing.T) {
+	for kind := HI; kind <= lastKind; kind++ {
+		if kind.String() == "UNKNOWN" {
+			t.Errorf("MessageKind(%d).String() = UNKNOWN", kind)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	if got := Detect([]byte(`{"type":"HI","name":"Tim"}`)); got != JSON {
+		t.Errorf("Detect() = %T, want JSON", got)
+	}
+	if got := Detect([]byte("HI Tim")); got != Text {
+		t.Errorf("Detect() = %T, want Text", got)
+	}
+}
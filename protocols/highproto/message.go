@@ -0,0 +1,442 @@
+package highproto
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a typed message of high level protocol.
+type Message interface {
+	// Kind returns kind of message.
+	Kind() MessageKind
+	// Params returns octets of message following the command in text format.
+	Params() []string
+}
+
+// Hi is an authorization message: HI <NAME>
+type Hi struct {
+	Name string
+}
+
+// Clients is a request for list of connected clients: CLIENTS [-v] [PREFIX] [OFFSET] [LIMIT]
+// Verbose listing contains status of every client. Listing is paginated when Limit is set,
+// the next page is requested by Offset or by continuation Token returned with the page.
+// Token is passed in place of offset in text format.
+type Clients struct {
+	Verbose bool
+	Prefix  string // empty - all names
+	Offset  int
+	Token   string
+	Limit   int
+}
+
+// Msg is a private message. Client sends it to the server with To field: MSG <TO> <TEXT>,
+// the server delivers it to receiver with From field: MSG <FROM> <TEXT>.
+// Text format doesn't carry the direction so it's always decoded into To field.
+type Msg struct {
+	From string
+	To   string
+	Text string
+}
+
+// Ping is a keep alive message sent by the server: PING
+type Ping struct{}
+
+// Pong is an answer of client on PING: PONG
+type Pong struct{}
+
+// Block is a request to drop messages from the client: BLOCK <NAME>
+type Block struct {
+	Name string
+}
+
+// Unblock is a request to deliver messages from blocked client again: UNBLOCK <NAME>
+type Unblock struct {
+	Name string
+}
+
+// Hide is a request to hide the client from CLIENTS listings: HIDE
+type Hide struct{}
+
+// Unhide is a request to show the client in CLIENTS listings again: UNHIDE
+type Unhide struct{}
+
+// Watch is a subscription to presence of the client or all clients by *: WATCH <NAME>
+type Watch struct {
+	Name string
+}
+
+// Unwatch cancels subscription to presence: UNWATCH <NAME>
+type Unwatch struct {
+	Name string
+}
+
+// Status sets status of the client shown in verbose listing: STATUS <STATE> [TEXT]
+type Status struct {
+	State string
+	Text  string
+}
+
+// History is a request for messages exchanged with the client: HISTORY <NAME> [SINCE-ID] [LIMIT]
+// The server replies by ENTRY per message followed by OK with amount of entries.
+type History struct {
+	Name    string
+	SinceID uint64 // 0 - the last messages
+	Limit   int    // 0 - default limit of the server
+}
+
+// Entry is a message from history: ENTRY <ID> <TIME> <FROM> <TEXT>
+// Time is unix time in milliseconds.
+type Entry struct {
+	ID   uint64
+	Time int64
+	From string
+	Text string
+}
+
+// Command is a custom command which isn't a part of the protocol itself,
+// e.g. registered by application embedding the server: <NAME> <ARG1> <ARG2> ...
+// Name consists of upper case latin letters, digits and underscores.
+type Command struct {
+	Name string
+	Args []string
+}
+
+// Ok is a successful response: OK <PARAMETER>
+type Ok struct {
+	Param string
+}
+
+// Error is a failure response: ERROR <REASON>
+type Error struct {
+	Reason string
+}
+
+func (Hi) Kind() MessageKind      { return HI }
+func (Clients) Kind() MessageKind { return CLIENTS }
+func (Msg) Kind() MessageKind     { return MSG }
+func (Ping) Kind() MessageKind    { return PING }
+func (Pong) Kind() MessageKind    { return PONG }
+func (Ok) Kind() MessageKind      { return OK }
+func (Error) Kind() MessageKind   { return ERROR }
+func (Block) Kind() MessageKind   { return BLOCK }
+func (Unblock) Kind() MessageKind { return UNBLOCK }
+func (Hide) Kind() MessageKind    { return HIDE }
+func (Unhide) Kind() MessageKind  { return UNHIDE }
+func (Watch) Kind() MessageKind   { return WATCH }
+func (Unwatch) Kind() MessageKind { return UNWATCH }
+func (Status) Kind() MessageKind  { return STATUS }
+func (History) Kind() MessageKind { return HISTORY }
+func (Entry) Kind() MessageKind   { return ENTRY }
+func (Command) Kind() MessageKind { return UNKNOWN }
+
+func (m Hi) Params() []string { return []string{m.Name} }
+func (m Clients) Params() []string {
+	var params []string
+	if m.Verbose {
+		params = append(params, VerboseFlag)
+	}
+	if m.Prefix == "" && m.Offset == 0 && m.Token == "" && m.Limit == 0 {
+		return params
+	}
+
+	prefix := m.Prefix
+	if prefix == "" {
+		prefix = AnyPrefix
+	}
+	params = append(params, prefix)
+	if m.Offset == 0 && m.Token == "" && m.Limit == 0 {
+		return params
+	}
+
+	offset := m.Token
+	if offset == "" {
+		offset = strconv.Itoa(m.Offset)
+	}
+	params = append(params, offset)
+	if m.Limit == 0 {
+		return params
+	}
+	return append(params, strconv.Itoa(m.Limit))
+}
+func (m Msg) Params() []string     { return []string{m.Peer(), m.Text} }
+func (Ping) Params() []string      { return nil }
+func (Pong) Params() []string      { return nil }
+func (m Ok) Params() []string      { return []string{m.Param} }
+func (m Error) Params() []string   { return []string{m.Reason} }
+func (m Block) Params() []string   { return []string{m.Name} }
+func (m Unblock) Params() []string { return []string{m.Name} }
+func (Hide) Params() []string      { return nil }
+func (Unhide) Params() []string    { return nil }
+func (m Watch) Params() []string   { return []string{m.Name} }
+func (m Unwatch) Params() []string { return []string{m.Name} }
+func (m Status) Params() []string {
+	if m.Text == "" {
+		return []string{m.State}
+	}
+	return []string{m.State, m.Text}
+}
+func (m History) Params() []string {
+	params := []string{m.Name}
+	if m.SinceID == 0 && m.Limit == 0 {
+		return params
+	}
+	params = append(params, strconv.FormatUint(m.SinceID, 10))
+	if m.Limit == 0 {
+		return params
+	}
+	return append(params, strconv.Itoa(m.Limit))
+}
+func (m Entry) Params() []string {
+	return []string{strconv.FormatUint(m.ID, 10), strconv.FormatInt(m.Time, 10), m.From, m.Text}
+}
+func (m Command) Params() []string {
+	return m.Args
+}
+
+// Name returns name of command of message as it's written in the first octet.
+func Name(m Message) string {
+	if c, ok := m.(Command); ok {
+		return c.Name
+	}
+	return m.Kind().String()
+}
+
+// Peer returns sender of message if it's set otherwise receiver.
+func (m Msg) Peer() string {
+	if m.From != "" {
+		return m.From
+	}
+	return m.To
+}
+
+// validate checks the message could be encoded by any codec without loss.
+func validate(m Message) error {
+	switch m := m.(type) {
+	case Hi:
+		return validateName(m.Name)
+	case Clients:
+		return validateClients(m)
+	case Msg:
+		return validateName(m.Peer())
+	case Block:
+		return validateName(m.Name)
+	case Unblock:
+		return validateName(m.Name)
+	case Watch:
+		return validateName(m.Name)
+	case Unwatch:
+		return validateName(m.Name)
+	case Status:
+		if err := validateName(m.State); err != nil {
+			return errors.Wrap(err, "state")
+		}
+	case History:
+		if m.Limit < 0 {
+			return errors.Wrap(ErrBadParam, "negative limit")
+		}
+		return validateName(m.Name)
+	case Entry:
+		return validateName(m.From)
+	case Command:
+		return validateCommand(m)
+	}
+	return nil
+}
+
+func validateClients(m Clients) error {
+	if m.Prefix == AnyPrefix || m.Prefix == VerboseFlag {
+		return errors.Wrapf(ErrBadParam, "prefix %s", m.Prefix)
+	}
+	if bytes.IndexByte([]byte(m.Prefix), Delimiter) >= 0 {
+		return errors.Wrap(ErrBadParam, "prefix contains delimiter")
+	}
+	if m.Offset < 0 || m.Limit < 0 {
+		return errors.Wrap(ErrBadParam, "negative offset or limit")
+	}
+	if m.Token != "" {
+		if m.Offset != 0 {
+			return errors.Wrap(ErrBadParam, "both offset and token")
+		}
+		if !strings.HasPrefix(m.Token, TokenPrefix) || bytes.IndexByte([]byte(m.Token), Delimiter) >= 0 {
+			return errors.Wrap(ErrBadParam, "bad token")
+		}
+	}
+	return nil
+}
+
+// newClients builds CLIENTS message from params of text format
+func newClients(params []string) (m Clients, err error) {
+	if len(params) > 0 && params[0] == VerboseFlag {
+		m.Verbose = true
+		params = params[1:]
+	}
+	if len(params) > 3 {
+		return m, errors.Wrap(ErrBadParam, "too many params")
+	}
+
+	if len(params) > 0 && params[0] != AnyPrefix {
+		m.Prefix = params[0]
+	}
+	if len(params) > 1 {
+		if strings.HasPrefix(params[1], TokenPrefix) {
+			m.Token = params[1]
+		} else if m.Offset, err = strconv.Atoi(params[1]); err != nil {
+			return m, errors.Wrap(ErrBadParam, "offset")
+		}
+	}
+	if len(params) > 2 {
+		if m.Limit, err = strconv.Atoi(params[2]); err != nil {
+			return m, errors.Wrap(ErrBadParam, "limit")
+		}
+	}
+	return m, nil
+}
+
+// newHistory builds HISTORY message from params of text format
+func newHistory(params []string) (m History, err error) {
+	m.Name = params[0]
+	if len(params) > 1 {
+		if m.SinceID, err = strconv.ParseUint(params[1], 10, 64); err != nil {
+			return m, errors.Wrap(ErrBadParam, "since id")
+		}
+	}
+	if len(params) > 2 {
+		if m.Limit, err = strconv.Atoi(params[2]); err != nil {
+			return m, errors.Wrap(ErrBadParam, "limit")
+		}
+	}
+	return m, nil
+}
+
+// newEntry builds ENTRY message from params of text format
+func newEntry(params []string) (m Entry, err error) {
+	if m.ID, err = strconv.ParseUint(params[0], 10, 64); err != nil {
+		return m, errors.Wrap(ErrBadParam, "id")
+	}
+	if m.Time, err = strconv.ParseInt(params[1], 10, 64); err != nil {
+		return m, errors.Wrap(ErrBadParam, "time")
+	}
+	m.From, m.Text = params[2], params[3]
+	return m, nil
+}
+
+func validateCommand(c Command) error {
+	if c.Name == "" {
+		return errors.Wrap(ErrBadParam, "empty command")
+	}
+	for i := 0; i < len(c.Name); i++ {
+		ch := c.Name[i]
+		if !(ch >= 'A' && ch <= 'Z' || i > 0 && (ch >= '0' && ch <= '9' || ch == '_')) {
+			return errors.Wrap(ErrBadParam, "command contains forbidden character")
+		}
+	}
+	for k := HI; k <= lastKind; k++ {
+		if c.Name == k.String() {
+			return errors.Wrapf(ErrBadParam, "%s is not a custom command", c.Name)
+		}
+	}
+	for _, arg := range c.Args {
+		if bytes.IndexByte([]byte(arg), Delimiter) >= 0 {
+			return errors.Wrap(ErrBadParam, "argument contains delimiter")
+		}
+	}
+	return nil
+}
+
+// parseCommand parses packet with unknown first octet as custom command.
+func parseCommand(packet []byte) (Message, error) {
+	parts := bytes.SplitN(packet, []byte{Delimiter}, 2)
+
+	c := Command{Name: string(parts[0])}
+	if len(parts) == 2 {
+		c.Args = strings.Split(string(parts[1]), string(rune(Delimiter)))
+	}
+
+	if err := validateCommand(c); err != nil {
+		return nil, errors.Wrap(ErrUnknownPacket, err.Error())
+	}
+
+	return c, nil
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return errors.Wrap(ErrBadParam, "empty name")
+	}
+	if bytes.IndexByte([]byte(name), Delimiter) >= 0 {
+		return errors.Wrap(ErrBadParam, "name contains delimiter")
+	}
+	// names are listed in lines of fields separated by tab
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return errors.Wrap(ErrBadParam, "name contains control character")
+	}
+	return nil
+}
+
+// newMessage builds typed message from kind and params returned by Parse.
+func newMessage(kind MessageKind, params []string) (Message, error) {
+	var m Message
+	switch kind {
+	case HI:
+		m = Hi{Name: params[0]}
+	case CLIENTS:
+		c, err := newClients(params)
+		if err != nil {
+			return nil, err
+		}
+		m = c
+	case MSG:
+		m = Msg{To: params[0], Text: params[1]}
+	case PING:
+		m = Ping{}
+	case PONG:
+		m = Pong{}
+	case OK:
+		m = Ok{Param: params[0]}
+	case ERROR:
+		m = Error{Reason: params[0]}
+	case BLOCK:
+		m = Block{Name: params[0]}
+	case UNBLOCK:
+		m = Unblock{Name: params[0]}
+	case HIDE:
+		m = Hide{}
+	case UNHIDE:
+		m = Unhide{}
+	case WATCH:
+		m = Watch{Name: params[0]}
+	case UNWATCH:
+		m = Unwatch{Name: params[0]}
+	case HISTORY:
+		h, err := newHistory(params)
+		if err != nil {
+			return nil, err
+		}
+		m = h
+	case ENTRY:
+		e, err := newEntry(params)
+		if err != nil {
+			return nil, err
+		}
+		m = e
+	case STATUS:
+		st := Status{State: params[0]}
+		if len(params) > 1 {
+			st.Text = params[1]
+		}
+		m = st
+	default:
+		return nil, ErrUnknownPacket
+	}
+
+	if err := validate(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,58 @@
+package lowproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// streamConn is an in-memory net.Conn which returns data by fragments of fixed size
+// like TCP stack does for big or slow packets.
+type streamConn struct {
+	r        io.Reader
+	fragment int
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if len(b) > c.fragment {
+		b = b[:c.fragment]
+	}
+	return c.r.Read(b)
+}
+
+func (c *streamConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *streamConn) Close() error                       { return nil }
+func (c *streamConn) LocalAddr() net.Addr                { return nil }
+func (c *streamConn) RemoteAddr() net.Addr               { return nil }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func FuzzReadPacket(f *testing.F) {
+	f.Fuzz(func(t *testing.T, stream []byte, fragment uint8) {
+		c := New(&streamConn{
+			r:        bytes.NewReader(stream),
+			fragment: int(fragment) + 1,
+		})
+
+		// read packets till the end of stream, each packet should match its frame
+		for offset := 0; ; {
+			packet, err := c.ReadPacket()
+			if err != nil {
+				if len(stream)-offset >= 2 && len(stream)-offset >= 2+int(binary.BigEndian.Uint16(stream[offset:])) {
+					t.Fatalf("ReadPacket() at %d error = %v for complete frame", offset, err)
+				}
+				return
+			}
+
+			length := int(binary.BigEndian.Uint16(stream[offset:]))
+			if !bytes.Equal(packet, stream[offset+2:offset+2+length]) {
+				t.Fatalf("ReadPacket() at %d = %x, want %x", offset, packet, stream[offset+2:offset+2+length])
+			}
+			offset += 2 + length
+		}
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,20 +18,26 @@ var (
 	ErrBadPacket = errors.New("bad packet")
 	ErrMismatch  = errors.New("mismatch")
 	ErrEOF       = errors.New("EOF")
+	ErrTooLarge  = errors.New("packet too large")
 )
 
+// MaxPacketSize is the max length of packet which fits uint16 length prefix.
+const MaxPacketSize = math.MaxUint16
+
 //go:generate mockgen -mock_names=Conn=MockNetConn -destination=conn_mock_test.go -package=lowproto net Conn
 
 // Config for create new Conn
 type Config struct {
 	ReadLendthTimeout time.Duration
 	ReadPacketTimeout time.Duration
+	WriteTimeout      time.Duration // 0 - unlimited
 }
 
 // Conn main wrapper for net connection
 type Conn struct {
-	config Config
-	conn   net.Conn
+	config      Config
+	conn        net.Conn
+	interrupted *int32 // shared by copies of Conn, set once by Interrupt
 }
 
 // option pattern to configure Conn
@@ -51,6 +59,13 @@ func ReadPacketTimeout(t time.Duration) ConnOpt {
 	}
 }
 
+// WriteTimeout set write timeout of packet, 0 - unlimited
+func WriteTimeout(t time.Duration) ConnOpt {
+	return func(c *Conn) {
+		c.config.WriteTimeout = t
+	}
+}
+
 // New creates new net.Conn wrapper to work with fragmented tcp packets
 func New(conn net.Conn, opts ...ConnOpt) Conn {
 	config := Config{
@@ -59,8 +74,9 @@ func New(conn net.Conn, opts ...ConnOpt) Conn {
 	}
 
 	c := Conn{
-		config: config,
-		conn:   conn,
+		config:      config,
+		conn:        conn,
+		interrupted: new(int32),
 	}
 
 	for _, opt := range opts {
@@ -76,23 +92,38 @@ func (c *Conn) Close() error {
 	return nil
 }
 
+// RemoteAddr returns the remote network address of underlaying connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Interrupt makes blocked ReadPacket return ErrTimeout immediately,
+// every following ReadPacket returns ErrTimeout without reading too.
+func (c *Conn) Interrupt() error {
+	if c.interrupted != nil {
+		atomic.StoreInt32(c.interrupted, 1)
+	}
+	return c.conn.SetReadDeadline(time.Now())
+}
+
+// isInterrupted is checked after every deadline is set, so the deadline set by Interrupt isn't lost
+func (c *Conn) isInterrupted() bool {
+	return c.interrupted != nil && atomic.LoadInt32(c.interrupted) == 1
+}
+
 // ReadPacket read fragmented packet from underlaying connection.
+// The packet may come by several fragments so reading continues till the whole packet is received.
 func (c *Conn) ReadPacket() (packet []byte, err error) {
 	bufLength := make([]byte, 2)
 
-	c.conn.SetDeadline(time.Now().Add(c.config.ReadLendthTimeout))
+	c.conn.SetReadDeadline(time.Now().Add(c.config.ReadLendthTimeout))
+	if c.isInterrupted() {
+		return nil, ErrTimeout
+	}
 
-	n, err := c.conn.Read(bufLength)
+	n, err := io.ReadFull(c.conn, bufLength)
 	if err != nil {
-		if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-			return nil, ErrTimeout
-		} else if err != io.EOF {
-			return nil, errors.Wrap(err, "read length bytes")
-		}
-		return nil, ErrEOF
-	}
-	if n != 2 {
-		return nil, errors.Wrap(ErrBadPacket, "length is not 2 bytes")
+		return nil, readErr(err, n > 0, "length is not 2 bytes")
 	}
 
 	var length uint16
@@ -103,31 +134,63 @@ func (c *Conn) ReadPacket() (packet []byte, err error) {
 	}
 
 	buf := make([]byte, length)
-	c.conn.SetDeadline(time.Now().Add(c.config.ReadPacketTimeout))
-	n, err = c.conn.Read(buf)
-	if err != nil {
-		if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-			return nil, ErrTimeout
-		} else if err != io.EOF {
-			return nil, errors.Wrap(err, "error occurred while reading packet")
-		}
-		return nil, ErrEOF
+	if length == 0 {
+		return buf, nil
 	}
-	if n != int(length) {
-		return nil, errors.Wrap(ErrBadPacket, "broken packet received")
+
+	c.conn.SetReadDeadline(time.Now().Add(c.config.ReadPacketTimeout))
+	if c.isInterrupted() {
+		return nil, errors.Wrap(ErrBadPacket, "interrupted in the middle of packet")
+	}
+	_, err = io.ReadFull(c.conn, buf)
+	if err != nil {
+		// the length is already consumed, so the rest of stream can't be framed anymore
+		return nil, readErr(err, true, "broken packet received")
 	}
 
 	return buf, nil
 }
 
+// readErr converts error of io.ReadFull to predefined errors.
+// Timeout is ErrTimeout only when nothing of the packet is read yet, in the middle of packet
+// it's ErrBadPacket because read bytes are lost and the stream is out of sync.
+func readErr(err error, partial bool, brokenMsg string) error {
+	if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+		if partial {
+			return errors.Wrap(ErrBadPacket, "timeout in the middle of packet")
+		}
+		return ErrTimeout
+	}
+	switch err {
+	case io.EOF:
+		return ErrEOF
+	case io.ErrUnexpectedEOF:
+		return errors.Wrap(ErrBadPacket, brokenMsg)
+	}
+	return errors.Wrap(err, "error occurred while reading packet")
+}
+
 // WritePacket write fragmented packet to underlaying connection.
+// Write of packet is limited by WriteTimeout, so a peer which doesn't read can't block it forever.
 func (c *Conn) WritePacket(packet []byte) (err error) {
+	if c.config.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+	return WriteFrame(c.conn, packet)
+}
+
+// WriteFrame writes packet prefixed by its length to w, e.g. to file.
+func WriteFrame(w io.Writer, packet []byte) error {
+	if len(packet) > MaxPacketSize {
+		return errors.Wrapf(ErrTooLarge, "%d bytes", len(packet))
+	}
+
 	lenBuf := make([]byte, 2)
 	length := uint16(len(packet))
 
 	binary.BigEndian.PutUint16(lenBuf, length)
 
-	n, err := c.conn.Write(append(lenBuf, packet...))
+	n, err := w.Write(append(lenBuf, packet...))
 	if err != nil {
 		return errors.Wrap(err, "write to connection")
 	}
@@ -138,3 +201,22 @@ func (c *Conn) WritePacket(packet []byte) (err error) {
 
 	return nil
 }
+
+// ReadFrame reads packet prefixed by its length from r, e.g. from file.
+// It returns ErrEOF when r is over and ErrBadPacket when the last packet is truncated.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	bufLength := make([]byte, 2)
+	if n, err := io.ReadFull(r, bufLength); err != nil {
+		return nil, readErr(err, n > 0, "length is not 2 bytes")
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(bufLength))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, readErr(err, true, "broken packet read")
+	}
+
+	return buf, nil
+}
@@ -1,20 +1,27 @@
 package lowproto
 
 import (
+	"bytes"
+	"io"
 	"net"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
+var timeoutErr = &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
 func TestConn_ReadPacket(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	conn := NewMockNetConn(ctrl)
-	conn.EXPECT().SetDeadline(gomock.Any()).Return(nil).AnyTimes()
+	conn.EXPECT().SetReadDeadline(gomock.Any()).Return(nil).AnyTimes()
 
 	type fields struct {
 		config Config
@@ -25,6 +32,7 @@ func TestConn_ReadPacket(t *testing.T) {
 		fields     fields
 		wantPacket []byte
 		wantErr    bool
+		wantCause  error
 		prepare    func() func()
 	}{
 		{
@@ -61,6 +69,55 @@ func TestConn_ReadPacket(t *testing.T) {
 					b[0] = 0x00
 					return 1, nil
 				})
+				conn.EXPECT().Read(gomock.Any()).Return(0, io.EOF)
+				return nil
+			},
+		},
+		{
+			name: "idle timeout",
+			fields: fields{
+				config: Config{},
+				conn:   conn,
+			},
+			wantErr:   true,
+			wantCause: ErrTimeout,
+			prepare: func() func() {
+				conn.EXPECT().Read(gomock.Any()).Return(0, timeoutErr)
+				return nil
+			},
+		},
+		{
+			name: "timeout in the middle of length",
+			fields: fields{
+				config: Config{},
+				conn:   conn,
+			},
+			wantErr:   true,
+			wantCause: ErrBadPacket,
+			prepare: func() func() {
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (n int, err error) {
+					b[0] = 0x00
+					return 1, nil
+				})
+				conn.EXPECT().Read(gomock.Any()).Return(0, timeoutErr)
+				return nil
+			},
+		},
+		{
+			name: "timeout in the middle of body",
+			fields: fields{
+				config: Config{},
+				conn:   conn,
+			},
+			wantErr:   true,
+			wantCause: ErrBadPacket,
+			prepare: func() func() {
+				conn.EXPECT().Read(gomock.Any()).DoAndReturn(func(b []byte) (n int, err error) {
+					b[0] = 0x00
+					b[1] = 0x02
+					return 2, nil
+				})
+				conn.EXPECT().Read(gomock.Any()).Return(0, timeoutErr)
 				return nil
 			},
 		},
@@ -84,6 +141,9 @@ func TestConn_ReadPacket(t *testing.T) {
 				t.Errorf("Conn.ReadPacket() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantCause != nil && errors.Cause(err) != tt.wantCause {
+				t.Errorf("Conn.ReadPacket() error = %v, want %v", err, tt.wantCause)
+			}
 			if !reflect.DeepEqual(gotPacket, tt.wantPacket) {
 				t.Errorf("Conn.ReadPacket() = %v, want %v", gotPacket, tt.wantPacket)
 			}
@@ -96,7 +156,7 @@ func TestConn_WritePacket(t *testing.T) {
 	defer ctrl.Finish()
 
 	conn := NewMockNetConn(ctrl)
-	conn.EXPECT().SetDeadline(gomock.Any()).Return(nil).AnyTimes()
+	conn.EXPECT().SetWriteDeadline(gomock.Any()).Return(nil).Times(1)
 
 	type fields struct {
 		config Config
@@ -148,6 +208,32 @@ func TestConn_WritePacket(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "write timeout",
+			fields: fields{
+				config: Config{WriteTimeout: time.Second},
+				conn:   conn,
+			},
+			wantErr: false,
+			args: args{
+				packet: []byte{0x41},
+			},
+			prepare: func() func() {
+				conn.EXPECT().Write(gomock.Any()).Return(3, nil)
+				return nil
+			},
+		},
+		{
+			name: "too large",
+			fields: fields{
+				config: Config{},
+				conn:   conn,
+			},
+			wantErr: true,
+			args: args{
+				packet: make([]byte, MaxPacketSize+1),
+			},
+		},
 		// it's possible to write more tests but it's not neccessary now because of time
 	}
 	for _, tt := range tests {
@@ -169,3 +255,43 @@ func TestConn_WritePacket(t *testing.T) {
 		})
 	}
 }
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteFrame(&buf, []byte("HI Tim")))
+	assert.NoError(t, WriteFrame(&buf, []byte{}))
+	assert.Error(t, WriteFrame(&buf, make([]byte, MaxPacketSize+1)))
+	assert.NoError(t, WriteFrame(&buf, []byte("MSG bob hello")))
+	buf.Truncate(buf.Len() - 1)
+
+	packet, err := ReadFrame(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("HI Tim"), packet)
+
+	packet, err = ReadFrame(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, packet)
+
+	_, err = ReadFrame(&buf)
+	assert.Equal(t, ErrBadPacket, errors.Cause(err))
+
+	_, err = ReadFrame(&buf)
+	assert.Equal(t, ErrEOF, err)
+}
+
+func TestConn_Interrupt(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := New(server)
+	defer c.Close()
+
+	// copies of Conn share the interruption like server's client and its read loop
+	interrupter := c
+	assert.NoError(t, interrupter.Interrupt())
+
+	// deadline set by ReadPacket doesn't cancel the interruption
+	_, err := c.ReadPacket()
+	assert.Equal(t, ErrTimeout, err)
+	_, err = c.ReadPacket()
+	assert.Equal(t, ErrTimeout, err)
+}
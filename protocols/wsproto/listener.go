@@ -0,0 +1,72 @@
+package wsproto
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Listener is net.Listener accepting WebSocket connections upgraded by ServeHTTP,
+// so it can be mounted to any HTTP server and passed to the server as usual listener.
+type Listener struct {
+	addr  net.Addr
+	opts  []UpgradeOpt
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewListener creates Listener, addr is address of HTTP server it's mounted to.
+// Options are passed to Upgrade of every request.
+func NewListener(addr net.Addr, opts ...UpgradeOpt) *Listener {
+	return &Listener{
+		addr:  addr,
+		opts:  opts,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades request to WebSocket and passes the connection to Accept.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	conn, err := Upgrade(w, r, l.opts...)
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept waits for next upgraded connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections, already accepted ones aren't closed.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns address of HTTP server the listener is mounted to.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
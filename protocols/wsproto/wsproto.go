@@ -0,0 +1,480 @@
+// Package wsproto bridges WebSocket connections to the low level protocol.
+// Every WebSocket message (text or binary) is one packet, so Conn looks like a plain
+// framed connection for lowproto and browsers can talk to the server unchanged.
+package wsproto
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Predefined errors
+var (
+	ErrHandshake = errors.New("bad handshake")
+	ErrBadFrame  = errors.New("bad frame")
+	ErrTooLarge  = errors.New("message too large")
+)
+
+// MaxMessageSize is the max length of message, the same as max length of lowproto packet.
+const MaxMessageSize = math.MaxUint16
+
+// magic string of RFC 6455 to compute Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Conn is WebSocket connection which looks like lowproto stream: Read returns every
+// received message prefixed by uint16 length, Write sends every length prefixed packet
+// as one message. Text messages are sent for valid UTF-8 packets, binary for the rest.
+// Ping, pong and close frames are handled transparently.
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // frames sent by client side are masked
+
+	rbuf   []byte // rest of packet not read yet
+	closed bool   // close frame is received
+
+	wmu       sync.Mutex
+	wbuf      []byte // incomplete packet not written yet
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		Conn:   conn,
+		br:     br,
+		client: client,
+	}
+}
+
+// option pattern to configure Upgrade
+
+// upgradeConfig of handshake on server side
+type upgradeConfig struct {
+	origins []string // empty - any origin is allowed
+}
+
+// UpgradeOpt option func
+type UpgradeOpt func(c *upgradeConfig)
+
+// AllowedOrigins set origins of pages allowed to open connection, e.g. https://example.com,
+// so pages of other sites can't connect on behalf of a browser. Requests without Origin header
+// are sent by non-browser clients and are always allowed. By default any origin is allowed.
+func AllowedOrigins(origins ...string) UpgradeOpt {
+	return func(c *upgradeConfig) {
+		c.origins = append(c.origins, origins...)
+	}
+}
+
+// allowed checks Origin header of request against allowed origins
+func (c upgradeConfig) allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(c.origins) == 0 || origin == "" {
+		return true
+	}
+	for _, allowed := range c.origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Upgrade makes handshake of WebSocket connection on server side.
+// An HTTP error is replied on failure.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts ...UpgradeOpt) (*Conn, error) {
+	var config upgradeConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.Wrap(ErrHandshake, "not upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, errors.Wrap(ErrHandshake, "unsupported version")
+	}
+	if !config.allowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, errors.Wrapf(ErrHandshake, "origin %s not allowed", r.Header.Get("Origin"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "websocket key required", http.StatusBadRequest)
+		return nil, errors.Wrap(ErrHandshake, "no key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, errors.Wrap(ErrHandshake, "response can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "hijack connection")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "write handshake response")
+	}
+
+	return newConn(conn, rw.Reader, false), nil
+}
+
+// Dial opens WebSocket connection on client side, url scheme is ws or wss.
+func Dial(rawurl string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse url")
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = net.Dial("tcp", hostPort(u, "80"))
+	case "wss":
+		conn, err = tls.Dial("tcp", hostPort(u, "443"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errors.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+
+	c, err := Client(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Client makes handshake of WebSocket connection on client side over existing connection.
+func Client(conn net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate key")
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, errors.Wrap(err, "write handshake request")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, errors.Wrap(err, "read handshake response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.Wrapf(ErrHandshake, "unexpected status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.Wrap(ErrHandshake, "wrong accept key")
+	}
+
+	return newConn(conn, br, true), nil
+}
+
+// Read reads received messages as length prefixed packets.
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(c.rbuf, uint16(len(msg)))
+		copy(c.rbuf[2:], msg)
+	}
+
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readMessage reads frames till the whole data message is received, control frames are handled meanwhile.
+func (c *Conn) readMessage() ([]byte, error) {
+	var (
+		msg     []byte
+		started bool
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			if started {
+				// frames of the message already read are lost
+				return nil, midFrame(err)
+			}
+			return nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeControl(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.closed = true
+			// echo status code as it's required by RFC 6455
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeControl(opClose, payload)
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				return nil, errors.Wrap(ErrBadFrame, "new message inside fragmented one")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, errors.Wrap(ErrBadFrame, "continuation without message")
+			}
+		default:
+			return nil, errors.Wrapf(ErrBadFrame, "unknown opcode %d", op)
+		}
+
+		if len(msg)+len(payload) > MaxMessageSize {
+			return nil, ErrTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin {
+			if msg == nil {
+				msg = []byte{}
+			}
+			return msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var h [2]byte
+	if n, err := io.ReadFull(c.br, h[:]); err != nil {
+		if n > 0 {
+			err = midFrame(err)
+		}
+		return fin, op, nil, err
+	}
+
+	fin = h[0]&0x80 != 0
+	op = h[0] & 0x0f
+	if h[0]&0x70 != 0 {
+		return fin, op, nil, errors.Wrap(ErrBadFrame, "reserved bits are set")
+	}
+	masked := h[1]&0x80 != 0
+	if masked == c.client {
+		return fin, op, nil, errors.Wrap(ErrBadFrame, "wrong masking")
+	}
+
+	length := uint64(h[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return fin, op, nil, midFrame(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return fin, op, nil, midFrame(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= opClose && (!fin || length > 125) {
+		return fin, op, nil, errors.Wrap(ErrBadFrame, "bad control frame")
+	}
+	if length > MaxMessageSize {
+		return fin, op, nil, ErrTooLarge
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, key[:]); err != nil {
+			return fin, op, nil, midFrame(err)
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return fin, op, nil, midFrame(err)
+	}
+	if masked {
+		mask(key, payload)
+	}
+
+	return fin, op, payload, nil
+}
+
+// Write sends every complete length prefixed packet as one message,
+// the rest is kept till next Write.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.wbuf = append(c.wbuf, p...)
+	for len(c.wbuf) >= 2 {
+		length := int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < 2+length {
+			break
+		}
+
+		packet := c.wbuf[2 : 2+length]
+		op := byte(opBinary)
+		if utf8.Valid(packet) {
+			op = opText
+		}
+		if err := c.writeFrame(op, packet); err != nil {
+			return 0, err
+		}
+		c.wbuf = append(c.wbuf[:0], c.wbuf[2+length:]...)
+	}
+
+	return len(p), nil
+}
+
+// Close sends close frame and closes underlaying connection.
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(opClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	c.wmu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *Conn) writeControl(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrame(op, payload)
+}
+
+// writeFrame writes single final frame, wmu should be held.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	if op == opClose {
+		if c.closeSent {
+			return nil
+		}
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 8+len(payload))
+	buf = append(buf, 0x80|op)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	if len(payload) < 126 {
+		buf = append(buf, maskBit|byte(len(payload)))
+	} else {
+		buf = append(buf, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return errors.Wrap(err, "generate mask")
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		mask(key, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func mask(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// midFrame reports error of reading in the middle of frame. Connection closed there is a broken frame,
+// timeout is ErrBadFrame because read bytes are lost and the next read can't continue the frame,
+// so only timeout before the first byte of message is an idle one.
+func midFrame(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errors.Wrap(ErrBadFrame, "timeout in the middle of frame")
+	}
+	return err
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
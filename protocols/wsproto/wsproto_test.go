@@ -0,0 +1,251 @@
+package wsproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// echoServer replies every packet back to the client
+func echoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		c := lowproto.New(conn)
+		defer c.Close()
+
+		for {
+			packet, err := c.ReadPacket()
+			if err != nil {
+				return
+			}
+			if err := c.WritePacket(packet); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func wsURL(ts *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestConn_RoundTrip(t *testing.T) {
+	ts := echoServer(t)
+	defer ts.Close()
+
+	conn, err := Dial(wsURL(ts))
+	assert.NoError(t, err)
+	c := lowproto.New(conn)
+	defer c.Close()
+
+	tests := []struct {
+		name   string
+		packet []byte
+		op     byte
+	}{
+		{name: "text", packet: []byte("HI client1"), op: opText},
+		{name: "binary", packet: []byte{0xff, 0x00, 0xfe}, op: opBinary},
+		{name: "empty", packet: []byte{}, op: opText},
+		{name: "extended length", packet: bytes.Repeat([]byte("a"), 1000), op: opText},
+		{name: "max length", packet: bytes.Repeat([]byte("a"), MaxMessageSize), op: opText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, c.WritePacket(tt.packet))
+			got, err := c.ReadPacket()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.packet, got)
+		})
+	}
+
+	t.Run("message type", func(t *testing.T) {
+		for _, tt := range tests[:2] {
+			assert.NoError(t, c.WritePacket(tt.packet))
+			fin, op, payload, err := conn.readFrame()
+			assert.NoError(t, err)
+			assert.True(t, fin)
+			assert.Equal(t, tt.op, op)
+			assert.Equal(t, tt.packet, payload)
+		}
+	})
+
+	t.Run("fragmented message", func(t *testing.T) {
+		conn.wmu.Lock()
+		assert.NoError(t, conn.writeFrame(opText, nil))
+		conn.wmu.Unlock()
+		got, err := c.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{}, got)
+
+		// first frame without FIN bit, then ping in the middle and continuation
+		conn.wmu.Lock()
+		frame := func(b0 byte, payload string) {
+			buf := []byte{b0, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+			_, err := conn.Conn.Write(append(buf, payload...))
+			assert.NoError(t, err)
+		}
+		frame(opText, "MSG client2 ")
+		frame(0x80|opPing, "ping")
+		frame(0x80|opContinuation, "hello")
+		conn.wmu.Unlock()
+
+		fin, op, payload, err := conn.readFrame()
+		assert.NoError(t, err)
+		assert.True(t, fin)
+		assert.Equal(t, byte(opPong), op)
+		assert.Equal(t, []byte("ping"), payload)
+
+		got, err = c.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("MSG client2 hello"), got)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		conn.Close()
+		_, err := c.ReadPacket()
+		assert.Error(t, err)
+	})
+}
+
+func TestUpgrade(t *testing.T) {
+	ts := echoServer(t)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestListener(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	l := NewListener(ts.Listener.Addr())
+	ts.Config.Handler = l
+	ts.Start()
+	defer ts.Close()
+
+	assert.Equal(t, ts.Listener.Addr(), l.Addr())
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := lowproto.New(conn)
+		packet, _ := c.ReadPacket()
+		c.WritePacket(append([]byte("echo "), packet...))
+		c.Close()
+	}()
+
+	conn, err := Dial(wsURL(ts))
+	assert.NoError(t, err)
+	c := lowproto.New(conn)
+	defer c.Close()
+
+	assert.NoError(t, c.WritePacket([]byte("hello")))
+	got, err := c.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("echo hello"), got)
+
+	l.Close()
+	_, err = l.Accept()
+	assert.Error(t, err)
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestConn_ReadTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		sent    []byte
+		badRead bool
+	}{
+		{name: "idle", sent: nil},
+		{name: "in the middle of header", sent: []byte{0x80 | opText}, badRead: true},
+		{name: "in the middle of payload", sent: []byte{0x80 | opText, 0x80 | 5, 0, 0, 0, 0, 'H'}, badRead: true},
+		{name: "in the middle of message", sent: []byte{opText, 0x80 | 1, 0, 0, 0, 0, 'H'}, badRead: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			conn := newConn(server, bufio.NewReader(server), false)
+			defer conn.Conn.Close()
+
+			go client.Write(tt.sent)
+
+			conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+			_, err := lowproto.ReadFrame(conn)
+			if tt.badRead {
+				assert.Equal(t, ErrBadFrame, errors.Cause(err))
+			} else {
+				assert.Equal(t, lowproto.ErrTimeout, err)
+			}
+		})
+	}
+}
+
+func TestUpgrade_AllowedOrigins(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := Upgrade(w, r, AllowedOrigins("https://example.com")); err == nil {
+			conn.Close()
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{origin: "https://example.com", status: http.StatusSwitchingProtocols},
+		{origin: "HTTPS://EXAMPLE.COM", status: http.StatusSwitchingProtocols},
+		{origin: "", status: http.StatusSwitchingProtocols},
+		{origin: "https://evil.com", status: http.StatusForbidden},
+		{origin: "https://example.com.evil.com", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			assert.NoError(t, err)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+}
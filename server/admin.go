@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// ErrUnknownClient is returned when there is no authorized client with the name.
+var ErrUnknownClient = errors.New("unknown client")
+
+// AdminAddr set address of admin HTTP API and token required in Authorization header as "Bearer <token>"
+func AdminAddr(addr, token string) ServerOpt {
+	return func(s *Server) {
+		s.config.AdminAddr = addr
+		s.config.AdminToken = token
+	}
+}
+
+// ClientInfo describes authorized client.
+type ClientInfo struct {
+	Name        string    `json:"name"`
+	Status      string    `json:"status"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	PacketsIn   int64     `json:"packets_in"`
+	PacketsOut  int64     `json:"packets_out"`
+}
+
+// Clients returns information about authorized clients sorted by name.
+func (s *Server) Clients() []ClientInfo {
+	clients := s.localClients()
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, cl := range clients {
+		state, _ := cl.status(s.config.AwayTimeout)
+		info := ClientInfo{
+			Name:        cl.Name(),
+			Status:      state,
+			ConnectedAt: cl.connectedAt,
+			BytesIn:     atomic.LoadInt64(&cl.bytesIn),
+			BytesOut:    atomic.LoadInt64(&cl.bytesOut),
+			PacketsIn:   atomic.LoadInt64(&cl.packetsIn),
+			PacketsOut:  atomic.LoadInt64(&cl.packetsOut),
+		}
+		if addr := cl.conn.RemoteAddr(); addr != nil {
+			info.RemoteAddr = addr.String()
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Kick disconnects authorized client sending it the reason from SYSTEM.
+// It doesn't wait for the client to read the reason, the connection is closed by writeLoop.
+func (s *Server) Kick(name, reason string) error {
+	c, ok := s.registry.Lookup(name)
+	cl, local := c.(*client)
+	if !ok || !local {
+		return errors.Wrap(ErrUnknownClient, name)
+	}
+
+	cl.drop(cl.codec, highproto.Msg{From: highproto.SYSTEM, Text: "kicked: " + reason}, "kicked: "+reason)
+	return nil
+}
+
+// Broadcast sends message from SYSTEM to all authorized clients.
+func (s *Server) Broadcast(text string) {
+	for _, cl := range s.localClients() {
+		if err := cl.Send(highproto.Msg{From: highproto.SYSTEM, Text: text}); err != nil {
+			s.log.WithError(err).Error("broadcast")
+		}
+	}
+}
+
+// AdminHandler returns http.Handler of admin API protected by token:
+//
+//	GET    /clients          - list of authorized clients
+//	DELETE /clients/<name>   - kick client, optional reason is passed in "reason" query param
+//	POST   /broadcast        - send {"text": "..."} to all clients from SYSTEM
+//	GET    /log-level        - current log level
+//	PUT    /log-level        - change log level by {"level": "debug"}
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", s.adminClients)
+	mux.HandleFunc("/clients/", s.adminKick)
+	mux.HandleFunc("/broadcast", s.adminBroadcast)
+	mux.HandleFunc("/log-level", s.adminLogLevel)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, adminError{Error: "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+type adminBroadcast struct {
+	Text string `json:"text"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) adminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Clients())
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/clients/")
+	reason := r.URL.Query().Get("reason")
+
+	if err := s.Kick(name, reason); err != nil {
+		writeJSON(w, http.StatusNotFound, adminError{Error: err.Error()})
+		return
+	}
+	s.log.WithFields(logrus.Fields{"client": name, "reason": reason}).Info("admin API: kick")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	var req adminBroadcast
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "text required"})
+		return
+	}
+
+	s.Broadcast(req.Text)
+	s.log.WithField("text", req.Text).Info("admin API: broadcast")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req adminLogLevel
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: "level required"})
+			return
+		}
+		level, err := logrus.ParseLevel(req.Level)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		s.log.Logger.SetLevel(level)
+		s.log.WithField("level", level).Info("admin API: log level changed")
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adminLogLevel{Level: s.log.Logger.GetLevel().String()})
+}
+
+// serveAdmin starts HTTP listener of admin API if it's configured.
+func (s *Server) serveAdmin() {
+	if s.config.AdminAddr == "" {
+		return
+	}
+	if s.config.AdminToken == "" {
+		s.log.Fatal("admin API requires token")
+	}
+
+	l, err := net.Listen("tcp", s.config.AdminAddr)
+	if err != nil {
+		s.log.WithError(err).Fatalf("listen admin API on %s", s.config.AdminAddr)
+	}
+
+	s.adminServer = &http.Server{Handler: s.AdminHandler(s.config.AdminToken)}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.adminServer.Serve(l); err != http.ErrServerClosed {
+			s.log.WithError(err).Error("serve admin API")
+		}
+	}()
+	s.log.Infof("admin API is running on http://%s", l.Addr())
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Role of client defines which commands are allowed for it.
+type Role byte
+
+const (
+	RoleUser Role = iota
+	RoleAdmin
+)
+
+// AdminToken set token which grants admin role by AUTH command
+func AdminToken(token string) ServerOpt {
+	return func(s *Server) {
+		s.config.AdminToken = token
+	}
+}
+
+// Role returns role of the client.
+func (ctx *Context) Role() Role {
+	return ctx.client.role
+}
+
+// Admin is a middleware which allows the command only for clients with admin role.
+func Admin(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context, params []string) error {
+		if ctx.Role() != RoleAdmin {
+			ctx.Log().WithField("client", ctx.Name()).Warn("audit: permission denied")
+			return ctx.Error("permission denied")
+		}
+		return next(ctx, params)
+	}
+}
+
+// audit is a middleware which logs each admin command with its result.
+func audit(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context, params []string) error {
+		err := next(ctx, params)
+		ctx.Log().WithFields(logrus.Fields{
+			"admin":  ctx.Name(),
+			"params": params,
+		}).WithError(err).Info("audit: admin command")
+		return err
+	}
+}
+
+// registerAdminCommands registers commands allowed only for admins.
+func (s *Server) registerAdminCommands() {
+	s.Handle("AUTH", s.handleAuth, Authorized)
+	s.Handle("KICK", s.handleKick, Authorized, Admin, audit)
+	s.Handle("ANNOUNCE", s.handleAnnounce, Authorized, Admin, audit)
+	s.Handle("STATS", s.handleStats, Authorized, Admin, audit)
+	s.Handle("SHUTDOWN", s.handleShutdown, Authorized, Admin, audit)
+}
+
+// handleAuth grants admin role: AUTH <TOKEN>
+func (s *Server) handleAuth(ctx *Context, params []string) error {
+	if len(params) != 1 || s.config.AdminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(params[0]), []byte(s.config.AdminToken)) != 1 {
+		ctx.Log().WithField("client", ctx.Name()).Warn("audit: wrong admin token")
+		return ctx.Error("wrong token")
+	}
+
+	ctx.client.role = RoleAdmin
+	ctx.Log().WithField("admin", ctx.Name()).Info("audit: admin role granted")
+
+	return ctx.OK("admin")
+}
+
+// handleKick disconnects client: KICK <NAME> <REASON>
+func (s *Server) handleKick(ctx *Context, params []string) error {
+	if len(params) < 1 {
+		return ctx.Error("name required")
+	}
+
+	if err := s.Kick(params[0], strings.Join(params[1:], " ")); err != nil {
+		return ctx.Error("unknown client")
+	}
+
+	return ctx.OK(params[0])
+}
+
+// handleAnnounce sends message to all clients from SYSTEM: ANNOUNCE <TEXT>
+func (s *Server) handleAnnounce(ctx *Context, params []string) error {
+	if len(params) < 1 {
+		return ctx.Error("text required")
+	}
+
+	s.Broadcast(strings.Join(params, " "))
+
+	return ctx.OK("")
+}
+
+// handleStats returns statistics of the server as "key value" lines: STATS
+func (s *Server) handleStats(ctx *Context, params []string) error {
+	s.mu.RLock()
+	conns := s.conns
+	s.mu.RUnlock()
+	authorized := len(s.registry.List())
+
+	stats := []string{
+		fmt.Sprintf("connections %d", conns),
+		fmt.Sprintf("authorized %d", authorized),
+		fmt.Sprintf("uptime %s", time.Since(s.started).Round(time.Second)),
+		fmt.Sprintf("version %s", Version),
+	}
+
+	return ctx.OK(strings.Join(stats, "\n"))
+}
+
+// maxShutdownDelay limits delay of SHUTDOWN, greater amount of seconds would overflow time.Duration
+const maxShutdownDelay = time.Hour * 24
+
+// handleShutdown stops the server after delay notifying all clients: SHUTDOWN <SECONDS>
+func (s *Server) handleShutdown(ctx *Context, params []string) error {
+	var seconds int
+	if len(params) > 0 {
+		var err error
+		if seconds, err = strconv.Atoi(params[0]); err != nil || seconds < 0 {
+			return ctx.Error("seconds should be non-negative integer")
+		}
+		if seconds > int(maxShutdownDelay/time.Second) {
+			return ctx.Error(fmt.Sprintf("seconds should be up to %d", int(maxShutdownDelay/time.Second)))
+		}
+	}
+
+	delay := time.Duration(seconds) * time.Second
+	s.Broadcast(fmt.Sprintf("server shutting down in %s", delay))
+
+	// StopGracefully waits for goroutine handling this command so it can't be called here
+	time.AfterFunc(delay, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+		defer cancel()
+		s.StopGracefully(ctx)
+	})
+
+	return ctx.OK(strconv.Itoa(seconds))
+}
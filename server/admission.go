@@ -0,0 +1,72 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// MaxConns set max amount of concurrent connections, 0 - unlimited
+func MaxConns(n int) ServerOpt {
+	return func(s *Server) {
+		s.config.MaxConns = n
+	}
+}
+
+// MaxUnauthConns set max amount of concurrent connections which didn't send HI yet, 0 - unlimited
+func MaxUnauthConns(n int) ServerOpt {
+	return func(s *Server) {
+		s.config.MaxUnauthConns = n
+	}
+}
+
+// HiTimeout set duration after connection during which client should send HI, 0 - unlimited
+func HiTimeout(t time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.config.HiTimeout = t
+	}
+}
+
+// admit checks limits of connections and counts new connection if it's admitted.
+func (s *Server) admit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.config.MaxConns > 0 && s.conns >= s.config.MaxConns {
+		return false
+	}
+	if s.config.MaxUnauthConns > 0 && s.unauthConns >= s.config.MaxUnauthConns {
+		return false
+	}
+
+	s.conns++
+	s.unauthConns++
+	return true
+}
+
+// dropUnauthorized closes connection of client if it didn't send HI yet.
+// It's called by timer so negotiated codec can't be used, the error is encoded by listener's codec.
+// HI accepted concurrently either wins and the client stays or fails as the client is dropped.
+func (s *Server) dropUnauthorized(cl *client) {
+	if !atomic.CompareAndSwapInt32(&cl.auth, authPending, authExpired) {
+		return
+	}
+
+	cl.drop(cl.defaultCodec, highproto.Error{Reason: "HI timeout"}, "HI timeout")
+}
+
+// notifyUnauthorized sends ERROR to clients which didn't send HI yet, since messages from SYSTEM reach
+// only authorized ones. The error is encoded by listener's codec like on HI timeout.
+func (s *Server) notifyUnauthorized(reason string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for cl := range s.clients {
+		if atomic.LoadInt32(&cl.auth) != authPending {
+			continue
+		}
+		if err := cl.sendBy(cl.defaultCodec, highproto.Error{Reason: reason}); err != nil {
+			s.log.WithError(err).Debug("notify unauthorized client")
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// Predefined errors of sending messages to client
+var (
+	ErrClientClosed = errors.New("client closed")
+	ErrQueueFull    = errors.New("send queue is full")
+)
+
+// client describes state of single connection
+type client struct {
+	conn         lowproto.Conn
+	codec        highproto.Codec // nil until negotiated
+	defaultCodec highproto.Codec // codec of listener used before negotiation
+	limiter      limiter
+	dropped      int32        // set to 1 when the server closes connection from another goroutine
+	dropReason   atomic.Value // string set before dropped
+	awaitingPong int32        // set to 1 when PING is sent and reset by PONG
+	role         Role         // accessed only by goroutine handling the connection
+	name         atomic.Value // string set by HI
+	auth         int32        // authPending till the first HI, changed by CAS only
+
+	pmu       sync.Mutex          // guards privacy settings changed by the client and read by others
+	blocked   map[string]struct{} // names of clients whose messages are dropped
+	hidden    bool                // hidden from CLIENTS listings of others
+	state     string              // status set by STATUS, empty - online
+	stateText string
+
+	connectedAt time.Time
+	lastActive  int64 // unix nano time of the last packet except PONG
+	bytesIn     int64 // counters are accessed atomically
+	bytesOut    int64
+	packetsIn   int64
+	packetsOut  int64
+
+	metrics *serverMetrics
+	out     chan outPacket // queue of packets written by writeLoop
+	done    chan struct{}  // closed when connection is closing
+	flushed chan struct{}  // closed when writeLoop wrote all queued packets
+}
+
+// States of client's authorization, HI and HI timeout race to change authPending
+const (
+	authPending int32 = iota
+	authDone
+	authExpired
+)
+
+// outPacket is an encoded message waiting in send queue
+type outPacket struct {
+	command string
+	packet  []byte
+	last    bool // connection is closed after the packet
+}
+
+// dropTimeout limits flushing of send queue of dropped client which doesn't read
+const dropTimeout = time.Second
+
+func newClient(conn lowproto.Conn, codec highproto.Codec, queueSize int, m *serverMetrics) *client {
+	defaultCodec := codec
+	if defaultCodec == nil {
+		defaultCodec = highproto.Text
+	}
+	now := time.Now()
+	return &client{
+		conn:         conn,
+		codec:        codec,
+		defaultCodec: defaultCodec,
+		connectedAt:  now,
+		lastActive:   now.UnixNano(),
+		metrics:      m,
+		out:          make(chan outPacket, queueSize),
+		done:         make(chan struct{}),
+		flushed:      make(chan struct{}),
+	}
+}
+
+// Name returns name of the client or empty string if it didn't send HI yet
+func (c *client) Name() string {
+	name, _ := c.name.Load().(string)
+	return name
+}
+
+// Send encodes message by client's codec and puts it to send queue
+func (c *client) Send(m highproto.Message) error {
+	return c.sendBy(c.codec, m)
+}
+
+// sendBy encodes message by given codec and puts it to send queue
+func (c *client) sendBy(codec highproto.Codec, m highproto.Message) error {
+	packet, err := codec.Marshal(m)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s", m.Kind())
+	}
+
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+
+	select {
+	case c.out <- outPacket{command: highproto.Name(m), packet: packet}:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	default:
+		return ErrQueueFull
+	}
+}
+
+// write encodes message by codec and writes it to connection bypassing send queue.
+// It's used for connections which are closed right after the message.
+func (c *client) write(codec highproto.Codec, m highproto.Message) error {
+	packet, err := codec.Marshal(m)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %s", m.Kind())
+	}
+	return c.writePacket(outPacket{command: highproto.Name(m), packet: packet})
+}
+
+func (c *client) writePacket(p outPacket) error {
+	err := c.conn.WritePacket(p.packet)
+	if err != nil {
+		c.metrics.lowprotoError(err)
+		return err
+	}
+	c.metrics.packetOut(p.command, len(p.packet))
+	atomic.AddInt64(&c.packetsOut, 1)
+	atomic.AddInt64(&c.bytesOut, int64(len(p.packet)+2))
+	return nil
+}
+
+// received counts packet read from connection
+func (c *client) received(packet []byte) {
+	atomic.AddInt64(&c.packetsIn, 1)
+	atomic.AddInt64(&c.bytesIn, int64(len(packet)+2))
+}
+
+// drop queues the last message and returns, writeLoop closes connection after it's written,
+// so the goroutine handling the connection stops reading. The reason is passed to observers.
+// Connection is closed right away when send queue is full and anyway after dropTimeout.
+func (c *client) drop(codec highproto.Codec, m highproto.Message, reason string) {
+	c.dropReason.Store(reason)
+	atomic.StoreInt32(&c.dropped, 1)
+
+	if packet, err := codec.Marshal(m); err == nil {
+		select {
+		case c.out <- outPacket{command: highproto.Name(m), packet: packet, last: true}:
+			time.AfterFunc(dropTimeout, func() { c.conn.Close() })
+			return
+		default:
+		}
+	}
+	c.conn.Close()
+}
+
+// writeLoop writes queued packets till the connection is closing, then flushes the rest of queue.
+// Failed write, e.g. by write timeout, or the last packet of dropped client closes the connection,
+// so the rest of packets fail fast and the goroutine handling the connection stops reading.
+func (c *client) writeLoop() {
+	defer close(c.flushed)
+
+	for {
+		select {
+		case p := <-c.out:
+			if err := c.writePacket(p); err != nil || p.last {
+				c.conn.Close()
+			}
+		case <-c.done:
+			for {
+				select {
+				case p := <-c.out:
+					if err := c.writePacket(p); err != nil || p.last {
+						c.conn.Close()
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// queueDepth returns amount of packets waiting in send queue
+func (c *client) queueDepth() int {
+	return len(c.out)
+}
@@ -0,0 +1,741 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// Peer link is lowproto framed connection between two nodes of cluster, every packet is
+// a space separated command. After handshake both nodes send requests over the link
+// and reply to requests of each other, so a link dialed by one of them is enough:
+//
+//	HELLO <node> <secret>            - handshake, both sides introduce themselves by the shared secret
+//	HAVE <name>                      - the name is held by the node, sent for all names on connect
+//	CLAIM <id> <name>                - request to take the name, replied by OK <id> or ERROR <id> <reason>
+//	RELEASE <name>                   - the name is free
+//	HIDE <name> / UNHIDE <name>      - the client is hidden from CLIENTS listings or shown again, HIDE follows HAVE
+//	ROUTE <id> <from> <to> <text>    - deliver the message, replied by OK <id> or ERROR <id> <reason>
+
+// Cluster errors
+var (
+	ErrNameTaken    = errors.New("name taken")
+	ErrNoCluster    = errors.New("cluster mode is disabled")
+	ErrBadHandshake = errors.New("bad handshake of peer")
+	errPeerTimeout  = errors.New("peer timeout")
+	errPeerClosed   = errors.New("peer link closed")
+	errSelf         = errors.New("peer is the node itself")
+)
+
+const (
+	// peerTimeout limits dialing and waiting for reply of peer
+	peerTimeout = time.Second * 2
+	// peerRetryInterval is a pause between attempts to connect peer
+	peerRetryInterval = time.Second
+)
+
+// Cluster set address of peer link listener and addresses of other nodes of cluster.
+// Names are unique cluster-wide and MSG is routed to the node holding the receiver.
+// ClusterSecret is required with it.
+func Cluster(addr string, peers ...string) ServerOpt {
+	return func(s *Server) {
+		s.config.ClusterAddr = addr
+		s.config.Peers = peers
+	}
+}
+
+// ClusterSecret set secret shared by all nodes of cluster, peers which don't know it are refused.
+// It's sent in plain text, so peer links should run in trusted network.
+func ClusterSecret(secret string) ServerOpt {
+	return func(s *Server) {
+		s.config.ClusterSecret = secret
+	}
+}
+
+// cluster keeps global registry of names: names of local clients and names held by peers.
+// Unreachable peers don't prevent taking names so the cluster stays available on failures.
+type cluster struct {
+	s    *Server
+	self string   // random node id
+	addr net.Addr // address of peer link listener
+	log  *logrus.Entry
+
+	mu       sync.Mutex
+	listener net.Listener           // nil when accepting is paused
+	local    map[string]bool        // names claimed by this node -> the client is hidden
+	remote   map[string]string      // name -> node holding it
+	hidden   map[string]struct{}    // names held by peers whose clients are hidden
+	links    map[string]*peerLink   // links requests are sent over by node
+	all      map[*peerLink]struct{} // all links including ones which aren't used for requests
+	dialing  map[string]struct{}    // addresses of peers being connected
+}
+
+// peerLink is connection to peer in either direction sending requests and replies.
+type peerLink struct {
+	node string
+	conn lowproto.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan []string // request id -> reply, nil when closed
+	seq     uint64
+}
+
+// serveCluster starts peer link listener and connects peers if cluster is configured.
+func (s *Server) serveCluster() {
+	if s.config.ClusterAddr == "" {
+		return
+	}
+	if s.config.ClusterSecret == "" {
+		s.log.Fatal("cluster secret is required")
+	}
+
+	l, err := net.Listen("tcp", s.config.ClusterAddr)
+	if err != nil {
+		s.log.WithError(err).Fatalf("listen cluster on %s", s.config.ClusterAddr)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		s.log.WithError(err).Fatal("generate cluster node id")
+	}
+
+	c := &cluster{
+		s:        s,
+		self:     hex.EncodeToString(id),
+		addr:     l.Addr(),
+		listener: l,
+		local:    make(map[string]bool),
+		remote:   make(map[string]string),
+		hidden:   make(map[string]struct{}),
+		links:    make(map[string]*peerLink),
+		all:      make(map[*peerLink]struct{}),
+		dialing:  make(map[string]struct{}),
+	}
+	c.log = s.log.WithField("node", c.self)
+	s.cluster = c
+
+	s.wg.Add(1)
+	go c.accept(l)
+
+	for _, addr := range s.config.Peers {
+		s.AddPeer(addr)
+	}
+	c.log.Infof("cluster node is running on %s", l.Addr())
+}
+
+// ClusterAddr returns address of peer link listener, nil if cluster mode is disabled.
+func (s *Server) ClusterAddr() net.Addr {
+	if s.cluster == nil {
+		return nil
+	}
+	return s.cluster.addr
+}
+
+// AddPeer connects node of cluster by address of its peer link listener.
+// The connection is reestablished till the server is stopped.
+func (s *Server) AddPeer(addr string) error {
+	if s.cluster == nil {
+		return ErrNoCluster
+	}
+
+	c := s.cluster
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.dialing[addr]; ok {
+		return nil
+	}
+	select {
+	case <-s.closing:
+		return ErrServerStopped
+	default:
+	}
+	c.dialing[addr] = struct{}{}
+
+	s.wg.Add(1)
+	go c.connect(addr)
+	return nil
+}
+
+// pause stops peer link listener keeping links.
+func (c *cluster) pause() {
+	c.mu.Lock()
+	l := c.listener
+	c.listener = nil
+	c.mu.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+}
+
+// resume opens peer link listener on the same address again.
+func (c *cluster) resume() error {
+	l, err := net.Listen("tcp", c.addr.String())
+	if err != nil {
+		return errors.Wrapf(err, "listen cluster on %s", c.addr)
+	}
+
+	c.mu.Lock()
+	c.listener = l
+	c.mu.Unlock()
+
+	c.s.wg.Add(1)
+	go c.accept(l)
+	return nil
+}
+
+// close stops peer link listener and closes all links.
+func (c *cluster) close() {
+	c.pause()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for link := range c.all {
+		link.conn.Close()
+	}
+}
+
+// claim takes the name cluster-wide. The name is refused if any reachable peer holds or claims it.
+func (c *cluster) claim(name string) error {
+	c.mu.Lock()
+	_, local := c.local[name]
+	_, remote := c.remote[name]
+	if local || remote {
+		c.mu.Unlock()
+		return ErrNameTaken
+	}
+	c.local[name] = false
+	links := c.peerLinks()
+	c.mu.Unlock()
+
+	var (
+		wg    sync.WaitGroup
+		taken int32
+	)
+	for _, link := range links {
+		wg.Add(1)
+		go func(link *peerLink) {
+			defer wg.Done()
+			reply, err := link.request("CLAIM", name)
+			if err != nil {
+				c.log.WithError(err).Warnf("claim %s on %s", name, link.node)
+				return
+			}
+			if reply[0] != "OK" {
+				atomic.StoreInt32(&taken, 1)
+			}
+		}(link)
+	}
+	wg.Wait()
+
+	if taken == 1 {
+		c.release(name)
+		return ErrNameTaken
+	}
+	return nil
+}
+
+// release frees the name claimed by this node.
+func (c *cluster) release(name string) {
+	c.mu.Lock()
+	delete(c.local, name)
+	links := c.peerLinks()
+	c.mu.Unlock()
+
+	for _, link := range links {
+		if err := link.send("RELEASE", name); err != nil {
+			c.log.WithError(err).Debugf("release %s on %s", name, link.node)
+		}
+	}
+}
+
+// setHidden shares hidden flag of the client holding the name with peers.
+func (c *cluster) setHidden(name string, hidden bool) {
+	c.mu.Lock()
+	if _, ok := c.local[name]; !ok {
+		c.mu.Unlock()
+		return
+	}
+	c.local[name] = hidden
+	links := c.peerLinks()
+	c.mu.Unlock()
+
+	cmd := "UNHIDE"
+	if hidden {
+		cmd = "HIDE"
+	}
+	for _, link := range links {
+		if err := link.send(cmd, name); err != nil {
+			c.log.WithError(err).Debugf("%s %s on %s", strings.ToLower(cmd), name, link.node)
+		}
+	}
+}
+
+// route delivers the message to client held by peer.
+func (c *cluster) route(from, to, text string) error {
+	c.mu.Lock()
+	node, ok := c.remote[to]
+	link := c.links[node]
+	c.mu.Unlock()
+	if !ok || link == nil {
+		return errors.Wrap(ErrUnknownClient, to)
+	}
+
+	reply, err := link.request("ROUTE", from, to, text)
+	if err != nil {
+		return errors.Wrapf(err, "route to %s", node)
+	}
+	if reply[0] != "OK" {
+		return errors.Wrap(ErrUnknownClient, to)
+	}
+	return nil
+}
+
+// names returns names held by peers except hidden ones.
+func (c *cluster) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.remote))
+	for name := range c.remote {
+		if _, hidden := c.hidden[name]; !hidden {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// grant records the name held by node unless it's held by someone else.
+func (c *cluster) grant(node, name string) bool {
+	c.mu.Lock()
+	if _, ok := c.local[name]; ok {
+		c.mu.Unlock()
+		return false
+	}
+	if holder, ok := c.remote[name]; ok && holder != node {
+		c.mu.Unlock()
+		return false
+	}
+	c.remote[name] = node
+	c.mu.Unlock()
+
+	// the client may reconnect to other node during grace period of its history
+	c.s.keepHistory(name)
+	return true
+}
+
+// holds checks that the name is held by node.
+func (c *cluster) holds(node, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote[name] == node
+}
+
+// forget frees the name if it's held by node.
+func (c *cluster) forget(node, name string) {
+	c.mu.Lock()
+	held := c.remote[name] == node
+	if held {
+		delete(c.remote, name)
+		delete(c.hidden, name)
+	}
+	c.mu.Unlock()
+
+	if held {
+		c.s.releaseHistory(name)
+	}
+}
+
+// hide sets hidden flag of the name if it's held by node.
+func (c *cluster) hide(node, name string, hidden bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.remote[name] != node {
+		return
+	}
+	if hidden {
+		c.hidden[name] = struct{}{}
+	} else {
+		delete(c.hidden, name)
+	}
+}
+
+// peerLinks returns snapshot of links to every peer, mu should be held.
+func (c *cluster) peerLinks() []*peerLink {
+	links := make([]*peerLink, 0, len(c.links))
+	for _, link := range c.links {
+		links = append(links, link)
+	}
+	return links
+}
+
+func (c *cluster) accept(l net.Listener) {
+	defer c.s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.listener != l
+			c.mu.Unlock()
+			if closed {
+				return
+			}
+			c.log.WithError(err).Error("accept peer")
+			continue
+		}
+
+		c.s.wg.Add(1)
+		go func() {
+			defer c.s.wg.Done()
+			c.serveInbound(conn)
+		}()
+	}
+}
+
+// serveInbound serves link accepted from peer until it's closed.
+func (c *cluster) serveInbound(conn net.Conn) {
+	lc := lowproto.New(conn, lowproto.ReadLengthTimeout(peerTimeout))
+
+	hello, err := lc.ReadPacket()
+	node, ok := c.checkHello(hello)
+	if err != nil || !ok {
+		c.log.WithError(err).Warnf("bad handshake of peer %s", conn.RemoteAddr())
+		lc.Close()
+		return
+	}
+	if err := lc.WritePacket(c.hello()); err != nil || node == c.self {
+		lc.Close()
+		return
+	}
+
+	link := newPeerLink(node, lc)
+	if err := c.addLink(link); err != nil {
+		lc.Close()
+		return
+	}
+	c.log.Infof("peer %s connected from %s", node, conn.RemoteAddr())
+	c.serveLink(link)
+}
+
+// hello returns handshake packet of the node
+func (c *cluster) hello() []byte {
+	return []byte("HELLO " + c.self + " " + c.s.config.ClusterSecret)
+}
+
+// checkHello parses handshake packet of peer, it's ok only when the peer knows the secret
+func (c *cluster) checkHello(packet []byte) (node string, ok bool) {
+	args := strings.SplitN(string(packet), " ", 3)
+	if len(args) != 3 || args[0] != "HELLO" || args[1] == "" {
+		return "", false
+	}
+	ok = subtle.ConstantTimeCompare([]byte(args[2]), []byte(c.s.config.ClusterSecret)) == 1
+	return args[1], ok
+}
+
+// handlePeer executes request of peer and returns reply if it's required.
+func (c *cluster) handlePeer(node, packet string) []byte {
+	cmd := strings.SplitN(packet, " ", 2)
+	switch cmd[0] {
+	case "HAVE":
+		if len(cmd) == 2 && !c.grant(node, cmd[1]) {
+			c.log.Warnf("name %s is held by %s and other node", cmd[1], node)
+		}
+	case "RELEASE":
+		if len(cmd) == 2 {
+			c.forget(node, cmd[1])
+		}
+	case "HIDE", "UNHIDE":
+		if len(cmd) == 2 {
+			c.hide(node, cmd[1], cmd[0] == "HIDE")
+		}
+	case "CLAIM":
+		args := strings.SplitN(packet, " ", 3)
+		if len(args) != 3 {
+			break
+		}
+		if !c.grant(node, args[2]) {
+			return []byte("ERROR " + args[1] + " the name already taken")
+		}
+		return []byte("OK " + args[1])
+	case "ROUTE":
+		args := strings.SplitN(packet, " ", 5)
+		if len(args) != 5 {
+			break
+		}
+		// the peer can send messages only on behalf of its own clients
+		if from := args[2]; from == highproto.SYSTEM || !c.holds(node, from) {
+			c.log.Warnf("peer %s routes message from %s which it doesn't hold", node, from)
+			return []byte("ERROR " + args[1] + " unknown sender of message")
+		}
+		if err := c.s.deliver(args[2], args[3], args[4]); err != nil {
+			return []byte("ERROR " + args[1] + " unknown receiver of message")
+		}
+		return []byte("OK " + args[1])
+	default:
+		c.log.Warnf("unexpected %s from peer %s", cmd[0], node)
+	}
+	return nil
+}
+
+// addLink registers link to peer after handshake and sends names of local clients over it.
+// The first link to the peer is used for requests, the rest ones are kept to replace it.
+func (c *cluster) addLink(link *peerLink) error {
+	c.mu.Lock()
+	select {
+	case <-c.s.closing:
+		c.mu.Unlock()
+		return ErrServerStopped
+	default:
+	}
+	c.all[link] = struct{}{}
+	if _, ok := c.links[link.node]; !ok {
+		c.links[link.node] = link
+	}
+	names := make(map[string]bool, len(c.local))
+	for name, hidden := range c.local {
+		names[name] = hidden
+	}
+	c.mu.Unlock()
+
+	for name, hidden := range names {
+		if err := link.send("HAVE", name); err != nil {
+			break
+		}
+		if !hidden {
+			continue
+		}
+		if err := link.send("HIDE", name); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// dropLink unregisters closed link, names held by the peer are forgotten when its last link is closed.
+func (c *cluster) dropLink(link *peerLink) {
+	c.mu.Lock()
+	delete(c.all, link)
+	if c.links[link.node] == link {
+		delete(c.links, link.node)
+	}
+	for other := range c.all {
+		if other.node == link.node {
+			if _, ok := c.links[link.node]; !ok {
+				c.links[link.node] = other
+			}
+			c.mu.Unlock()
+			return
+		}
+	}
+	var released []string
+	for name, holder := range c.remote {
+		if holder == link.node {
+			delete(c.remote, name)
+			delete(c.hidden, name)
+			released = append(released, name)
+		}
+	}
+	c.mu.Unlock()
+
+	c.log.Infof("peer %s disconnected", link.node)
+	for _, name := range released {
+		c.s.releaseHistory(name)
+	}
+}
+
+// connect keeps outbound link to peer till the server is stopped.
+func (c *cluster) connect(addr string) {
+	defer c.s.wg.Done()
+
+	for {
+		link, err := c.dial(addr)
+		if err == errSelf {
+			return
+		}
+		if err != nil {
+			c.log.WithError(err).Debugf("connect peer %s", addr)
+		} else {
+			c.serveLink(link)
+		}
+
+		select {
+		case <-c.s.closing:
+			return
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+func (c *cluster) dial(addr string) (*peerLink, error) {
+	conn, err := net.DialTimeout("tcp", addr, peerTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial")
+	}
+	lc := lowproto.New(conn, lowproto.ReadLengthTimeout(peerTimeout))
+
+	if err := lc.WritePacket(c.hello()); err != nil {
+		lc.Close()
+		return nil, errors.Wrap(err, "write hello")
+	}
+	hello, err := lc.ReadPacket()
+	node, ok := c.checkHello(hello)
+	if err != nil || !ok {
+		lc.Close()
+		return nil, errors.Wrap(ErrBadHandshake, addr)
+	}
+	if node == c.self {
+		lc.Close()
+		return nil, errSelf
+	}
+
+	link := newPeerLink(node, lc)
+	if err := c.addLink(link); err != nil {
+		lc.Close()
+		return nil, err
+	}
+
+	c.log.Infof("peer %s connected on %s", link.node, addr)
+	return link, nil
+}
+
+func newPeerLink(node string, conn lowproto.Conn) *peerLink {
+	return &peerLink{
+		node:    node,
+		conn:    conn,
+		pending: make(map[string]chan []string),
+	}
+}
+
+// serveLink replies requests of peer and passes replies to pending requests until the link is closed.
+func (c *cluster) serveLink(link *peerLink) {
+	defer func() {
+		c.dropLink(link)
+		link.close()
+	}()
+
+	for {
+		packet, err := link.conn.ReadPacket()
+		if err != nil {
+			if errors.Cause(err) == lowproto.ErrTimeout {
+				select {
+				case <-c.s.closing:
+					return
+				default:
+					continue
+				}
+			}
+			return
+		}
+
+		// OK <id> or ERROR <id> <reason>
+		reply := strings.SplitN(string(packet), " ", 3)
+		if reply[0] != "OK" && reply[0] != "ERROR" {
+			if resp := c.handlePeer(link.node, string(packet)); resp != nil {
+				if err := link.send(string(resp)); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if len(reply) < 2 {
+			continue
+		}
+		link.mu.Lock()
+		ch, ok := link.pending[reply[1]]
+		delete(link.pending, reply[1])
+		link.mu.Unlock()
+		if ok {
+			ch <- reply
+		}
+	}
+}
+
+// send writes command to peer.
+func (l *peerLink) send(fields ...string) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	return l.conn.WritePacket([]byte(strings.Join(fields, " ")))
+}
+
+// request writes command with unique id and waits for reply.
+func (l *peerLink) request(cmd string, args ...string) ([]string, error) {
+	ch := make(chan []string, 1)
+
+	l.mu.Lock()
+	if l.pending == nil {
+		l.mu.Unlock()
+		return nil, errPeerClosed
+	}
+	l.seq++
+	id := strconv.FormatUint(l.seq, 10)
+	l.pending[id] = ch
+	l.mu.Unlock()
+
+	if err := l.send(append([]string{cmd, id}, args...)...); err != nil {
+		l.mu.Lock()
+		delete(l.pending, id)
+		l.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, errPeerClosed
+		}
+		return reply, nil
+	case <-time.After(peerTimeout):
+		l.mu.Lock()
+		delete(l.pending, id)
+		l.mu.Unlock()
+		return nil, errPeerTimeout
+	}
+}
+
+// close closes connection and fails pending requests.
+func (l *peerLink) close() {
+	l.conn.Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ch := range l.pending {
+		close(ch)
+	}
+	l.pending = nil
+}
+
+// deliver sends message routed by peer to local client, messages from blocked senders are dropped silently.
+// The delivered message is recorded by this node as well as by the node of the sender,
+// so history of the conversation is available on both of them.
+func (s *Server) deliver(from, to, text string) error {
+	cl, ok := s.registry.Lookup(to)
+	if !ok {
+		return errors.Wrap(ErrUnknownClient, to)
+	}
+	if blockedBy(cl, from) {
+		return nil
+	}
+
+	if err := cl.Send(highproto.Msg{From: from, Text: text}); err != nil {
+		return err
+	}
+	s.recordDelivered(from, to, text)
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// HandlerFunc handles a command of high level protocol.
+// Returned error closes the connection, so reasons meant for client should be sent by ctx.Error.
+type HandlerFunc func(ctx *Context, params []string) error
+
+// Middleware wraps handler to run some logic before or after it,
+// e.g. to check authorization, limit rate or log commands.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Context of command being handled.
+type Context struct {
+	// Message is decoded message, custom commands are represented by highproto.Command.
+	Message highproto.Message
+
+	server *Server
+	client *client
+}
+
+// Server returns the server which received the command.
+func (ctx *Context) Server() *Server {
+	return ctx.server
+}
+
+// Command returns name of the command.
+func (ctx *Context) Command() string {
+	return highproto.Name(ctx.Message)
+}
+
+// Name returns name of authorized client or empty string if client didn't send HI yet.
+func (ctx *Context) Name() string {
+	return ctx.client.Name()
+}
+
+// Log returns logger with fields of the command.
+func (ctx *Context) Log() *logrus.Entry {
+	return ctx.server.log.WithField("command", ctx.Command())
+}
+
+// Send sends message to the client.
+func (ctx *Context) Send(m highproto.Message) error {
+	return ctx.client.Send(m)
+}
+
+// OK sends OK response to the client.
+func (ctx *Context) OK(param string) error {
+	return ctx.client.Send(highproto.Ok{Param: param})
+}
+
+// Error sends ERROR response to the client.
+func (ctx *Context) Error(reason string) error {
+	return ctx.client.Send(highproto.Error{Reason: reason})
+}
+
+// Handle registers handler for the command. Middlewares are applied in the given order
+// after the ones registered by Use. Registering the command again replaces its handler.
+func (s *Server) Handle(command string, h HandlerFunc, mws ...Middleware) {
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+	s.handlers[command] = chain(h, mws)
+	s.metrics.command(command)
+	s.buildChains()
+}
+
+// Use registers middlewares applied to all commands.
+func (s *Server) Use(mws ...Middleware) {
+	s.hmu.Lock()
+	defer s.hmu.Unlock()
+	s.middlewares = append(s.middlewares, mws...)
+	s.buildChains()
+}
+
+// buildChains wraps all handlers by global middlewares once, so packets are dispatched without locking.
+// hmu should be held.
+func (s *Server) buildChains() {
+	chains := make(map[string]HandlerFunc, len(s.handlers))
+	for command, h := range s.handlers {
+		chains[command] = chain(h, s.middlewares)
+	}
+	s.chains.Store(chains)
+}
+
+// handler returns handler of the command wrapped by global middlewares.
+func (s *Server) handler(command string) (HandlerFunc, bool) {
+	chains, _ := s.chains.Load().(map[string]HandlerFunc)
+	h, ok := chains[command]
+	return h, ok
+}
+
+// chain wraps handler by middlewares so the first middleware runs first.
+func chain(h HandlerFunc, mws []Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Authorized is a middleware which allows the command only for clients sent HI.
+func Authorized(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context, params []string) error {
+		if ctx.Name() == "" {
+			return ctx.Error("HI required")
+		}
+		return next(ctx, params)
+	}
+}
+
+// Logging is a middleware which logs each command with its duration on debug level.
+func Logging(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context, params []string) error {
+		start := time.Now()
+		err := next(ctx, params)
+		ctx.Log().WithFields(logrus.Fields{
+			"client":   ctx.Name(),
+			"duration": time.Since(start),
+		}).WithError(err).Debug("command handled")
+		return err
+	}
+}
@@ -0,0 +1,423 @@
+package server
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// HistoryEntry is a message kept in history.
+type HistoryEntry struct {
+	ID   uint64
+	Time time.Time
+	From string
+	To   string
+	Text string
+}
+
+// HistoryStore keeps messages exchanged by pairs of clients.
+// Implementations should be safe for concurrent use.
+type HistoryStore interface {
+	// Append stores the message and returns its ID. ID is assigned by the store when it's 0,
+	// otherwise it's kept, e.g. when history is restored.
+	Append(e HistoryEntry) (uint64, error)
+	// Range returns up to limit messages exchanged by the pair of clients in both directions sorted by ID.
+	// Messages with ID greater than sinceID are returned, when sinceID is 0 the last messages are returned.
+	Range(a, b string, sinceID uint64, limit int) ([]HistoryEntry, error)
+	// Forget drops messages exchanged by the client with anyone. It's called when the name isn't taken again
+	// during grace period after it's released, so the next client taking the name later can't read them.
+	Forget(name string) error
+}
+
+// DefaultHistoryGrace is a duration history of released name is kept when grace period isn't set.
+const DefaultHistoryGrace = time.Minute * 10
+
+// DefaultHistorySize is amount of messages kept per pair of clients when size isn't set.
+const DefaultHistorySize = 100
+
+// DefaultHistoryPairs is amount of pairs of clients which messages are kept when it isn't set.
+const DefaultHistoryPairs = 10000
+
+// defaultHistoryLimit is amount of messages sent by HISTORY without limit
+const defaultHistoryLimit = 20
+
+// MessageHistory set store of messages retrievable by HISTORY command, history is disabled by default
+func MessageHistory(store HistoryStore) ServerOpt {
+	return func(s *Server) {
+		s.history = store
+	}
+}
+
+// HistoryGrace set duration history of released name is kept for its client to reconnect, 0 - till it expires
+func HistoryGrace(t time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.config.HistoryGrace = t
+	}
+}
+
+// ReleasedNames set names released before the server is started, e.g. returned by RestoreHistory.
+// Their history is dropped after grace period unless clients take them back.
+func ReleasedNames(names ...string) ServerOpt {
+	return func(s *Server) {
+		s.released = append(s.released, names...)
+	}
+}
+
+// handleHistory sends messages exchanged with the client by ENTRY
+// followed by OK with amount of sent entries: HISTORY <NAME> [SINCE-ID] [LIMIT].
+// Limit is cut to half of send queue and to its free space so entries don't overflow it,
+// when the queue is filled by other packets meanwhile the rest of entries isn't sent.
+func (s *Server) handleHistory(ctx *Context, params []string) error {
+	if s.history == nil {
+		return ctx.Error("history is disabled")
+	}
+
+	m := ctx.Message.(highproto.History)
+	limit := m.Limit
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	if max := s.config.SendQueueSize / 2; limit > max {
+		limit = max
+	}
+	// one packet is left for OK
+	if free := cap(ctx.client.out) - len(ctx.client.out) - 1; limit > free {
+		limit = free
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	entries, err := s.history.Range(ctx.Name(), m.Name, m.SinceID, limit)
+	if err != nil {
+		ctx.Log().WithError(err).Error("read history")
+		return ctx.Error("history is unavailable")
+	}
+
+	var sent int
+	for _, e := range entries {
+		err := ctx.Send(highproto.Entry{
+			ID:   e.ID,
+			Time: e.Time.UnixNano() / int64(time.Millisecond),
+			From: e.From,
+			Text: e.Text,
+		})
+		if err == ErrQueueFull {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sent++
+	}
+	return ctx.OK(strconv.Itoa(sent))
+}
+
+// pendingForget is dropping of history of released name scheduled after grace period
+type pendingForget struct {
+	timer *time.Timer
+}
+
+// releaseHistory schedules dropping of history of the released name after grace period,
+// so its client can reconnect and catch up meanwhile, but the next client taking the name later can't read it.
+func (s *Server) releaseHistory(name string) {
+	if s.history == nil || s.config.HistoryGrace <= 0 {
+		return
+	}
+
+	s.forgetMu.Lock()
+	defer s.forgetMu.Unlock()
+
+	if p, ok := s.forgets[name]; ok {
+		p.timer.Stop()
+	}
+	p := &pendingForget{}
+	p.timer = time.AfterFunc(s.config.HistoryGrace, func() {
+		s.forgetHistory(name, p)
+	})
+	s.forgets[name] = p
+}
+
+// keepHistory cancels dropping of history of the name taken again during grace period
+func (s *Server) keepHistory(name string) {
+	s.forgetMu.Lock()
+	defer s.forgetMu.Unlock()
+
+	if p, ok := s.forgets[name]; ok {
+		p.timer.Stop()
+		delete(s.forgets, name)
+	}
+}
+
+// forgetHistory drops history of the name when its grace period is over and logs it to write-ahead log.
+// History isn't dropped after the server is stopping, clients may reconnect after restart
+// and grace period starts again when the name is passed to the next process by ReleasedNames.
+func (s *Server) forgetHistory(name string, p *pendingForget) {
+	s.forgetMu.Lock()
+	if s.forgets[name] != p { // the name is taken again or released once more
+		s.forgetMu.Unlock()
+		return
+	}
+	delete(s.forgets, name)
+	s.forgetMu.Unlock()
+
+	select {
+	case <-s.closing:
+		return
+	default:
+	}
+
+	if err := s.history.Forget(name); err != nil {
+		s.log.WithError(err).Error("forget history")
+	}
+	s.logForget(name)
+}
+
+// recordDelivered appends message to history and write-ahead log if they're enabled,
+// the message is logged with id assigned by history. It's called after the message is queued
+// to the receiver or routed, so only delivered messages are recorded, but a message delivered
+// right before crash may be missing in the log.
+func (s *Server) recordDelivered(from, to, text string) {
+	e := HistoryEntry{Time: time.Now(), From: from, To: to, Text: text}
+	if s.history != nil {
+		id, err := s.history.Append(e)
+		if err != nil {
+			s.log.WithError(err).Error("append history")
+		}
+		e.ID = id
+	}
+	s.logMessage(e)
+}
+
+// memHistory is in-memory HistoryStore keeping the last messages of every pair in ring buffer.
+// Rings grow on demand, empty ones are deleted and the least recently used pair is evicted
+// when there are too many of them.
+type memHistory struct {
+	mu       sync.Mutex
+	size     int
+	ttl      time.Duration
+	maxPairs int
+	seq      uint64
+	pairs    map[string]*historyRing
+	names    map[string]map[string]struct{} // keys of pairs by name
+	lru      *list.List                     // keys of pairs, the recently used one is the first
+	swept    time.Time                      // time of the last removal of expired entries of all pairs
+}
+
+// NewMemHistory creates in-memory HistoryStore keeping up to size messages per pair of clients
+// which aren't older than ttl, 0 ttl - messages don't expire. Up to maxPairs pairs are kept,
+// messages of the pair which didn't exchange them for the longest time are dropped first.
+func NewMemHistory(size int, ttl time.Duration, maxPairs int) HistoryStore {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	if maxPairs <= 0 {
+		maxPairs = DefaultHistoryPairs
+	}
+	return &memHistory{
+		size:     size,
+		ttl:      ttl,
+		maxPairs: maxPairs,
+		pairs:    make(map[string]*historyRing),
+		names:    make(map[string]map[string]struct{}),
+		lru:      list.New(),
+		swept:    time.Now(),
+	}
+}
+
+// pairKey returns the same key for both directions of conversation
+func pairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+func (h *memHistory) Append(e HistoryEntry) (uint64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e.ID == 0 {
+		h.seq++
+		e.ID = h.seq
+	} else if e.ID > h.seq {
+		h.seq = e.ID
+	}
+
+	key := pairKey(e.From, e.To)
+	r, ok := h.pairs[key]
+	if ok {
+		h.lru.MoveToFront(r.elem)
+	} else {
+		if len(h.pairs) >= h.maxPairs {
+			h.remove(h.lru.Back().Value.(string))
+		}
+		r = &historyRing{a: e.From, b: e.To, elem: h.lru.PushFront(key)}
+		h.pairs[key] = r
+		h.index(e.From, key)
+		h.index(e.To, key)
+	}
+	r.push(e, h.size)
+
+	if h.ttl > 0 {
+		now := time.Now()
+		r.expire(now.Add(-h.ttl))
+		if r.n == 0 { // restored entry is expired already
+			h.remove(key)
+		}
+		// entries of pairs which don't exchange messages anymore are removed once in ttl
+		if now.Sub(h.swept) > h.ttl {
+			h.sweep(now.Add(-h.ttl))
+			h.swept = now
+		}
+	}
+	return e.ID, nil
+}
+
+func (h *memHistory) Range(a, b string, sinceID uint64, limit int) ([]HistoryEntry, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := pairKey(a, b)
+	r, ok := h.pairs[key]
+	if !ok {
+		return nil, nil
+	}
+	var expired time.Time
+	if h.ttl > 0 {
+		expired = time.Now().Add(-h.ttl)
+		r.expire(expired)
+		if r.n == 0 {
+			h.remove(key)
+			return nil, nil
+		}
+	}
+
+	var entries []HistoryEntry
+	for i := 0; i < r.n; i++ {
+		e := r.at(i)
+		if e.ID > sinceID && e.Time.After(expired) {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(entries) > limit {
+		if sinceID == 0 {
+			entries = entries[len(entries)-limit:]
+		} else {
+			entries = entries[:limit]
+		}
+	}
+	return entries, nil
+}
+
+func (h *memHistory) Forget(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range h.names[name] {
+		h.remove(key)
+	}
+	return nil
+}
+
+// sweep removes entries older than the time from all pairs, mu should be held
+func (h *memHistory) sweep(before time.Time) {
+	for key, r := range h.pairs {
+		r.expire(before)
+		if r.n == 0 {
+			h.remove(key)
+		}
+	}
+}
+
+// remove deletes the pair, mu should be held
+func (h *memHistory) remove(key string) {
+	r, ok := h.pairs[key]
+	if !ok {
+		return
+	}
+	delete(h.pairs, key)
+	h.lru.Remove(r.elem)
+	h.unindex(r.a, key)
+	h.unindex(r.b, key)
+}
+
+// index adds key of pair to keys of the name, mu should be held
+func (h *memHistory) index(name, key string) {
+	keys, ok := h.names[name]
+	if !ok {
+		keys = make(map[string]struct{})
+		h.names[name] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// unindex removes key of pair from keys of the name, mu should be held
+func (h *memHistory) unindex(name, key string) {
+	keys := h.names[name]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(h.names, name)
+	}
+}
+
+// minHistoryRing is initial capacity of ring, it's doubled up to size of history when it's full
+const minHistoryRing = 4
+
+// historyRing is a ring buffer of messages, the oldest one is overwritten when it's full
+type historyRing struct {
+	a, b    string        // names of pair
+	elem    *list.Element // element of the pair in lru
+	entries []HistoryEntry
+	head    int // index of the oldest entry
+	n       int // amount of entries
+}
+
+// push adds the entry growing buffer up to size entries
+func (r *historyRing) push(e HistoryEntry, size int) {
+	if r.n == len(r.entries) && r.n < size {
+		r.grow(size)
+	}
+	if r.n < len(r.entries) {
+		r.entries[(r.head+r.n)%len(r.entries)] = e
+		r.n++
+		return
+	}
+	r.entries[r.head] = e
+	r.head = (r.head + 1) % len(r.entries)
+}
+
+// grow doubles capacity of buffer up to size entries
+func (r *historyRing) grow(size int) {
+	n := len(r.entries) * 2
+	if n < minHistoryRing {
+		n = minHistoryRing
+	}
+	if n > size {
+		n = size
+	}
+	entries := make([]HistoryEntry, n)
+	for i := 0; i < r.n; i++ {
+		entries[i] = r.at(i)
+	}
+	r.entries = entries
+	r.head = 0
+}
+
+// at returns i-th entry starting from the oldest one
+func (r *historyRing) at(i int) HistoryEntry {
+	return r.entries[(r.head+i)%len(r.entries)]
+}
+
+// expire drops entries older than the time
+func (r *historyRing) expire(before time.Time) {
+	for r.n > 0 && r.entries[r.head].Time.Before(before) {
+		r.entries[r.head] = HistoryEntry{}
+		r.head = (r.head + 1) % len(r.entries)
+		r.n--
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Action is decision of Interceptor about message.
+type Action int
+
+// Actions of interceptors
+const (
+	ActionDeliver Action = iota // deliver the message as is
+	ActionModify                // deliver the message with replaced text
+	ActionReject                // don't deliver the message, the reason is sent to sender by ERROR
+)
+
+// Decision is result of Interceptor.
+type Decision struct {
+	Action Action
+	Text   string // text to deliver for ActionModify
+	Reason string // reason for ActionReject
+}
+
+// Deliver returns decision to deliver the message as is.
+func Deliver() Decision {
+	return Decision{Action: ActionDeliver}
+}
+
+// Modify returns decision to deliver the message with another text.
+func Modify(text string) Decision {
+	return Decision{Action: ActionModify, Text: text}
+}
+
+// Reject returns decision to drop the message and reply the reason to sender.
+func Reject(reason string) Decision {
+	return Decision{Action: ActionReject, Reason: reason}
+}
+
+// Interceptor inspects MSG before delivery, e.g. to filter profanity, redact PII or block pairs of clients.
+// It's called by goroutine handling sender's connection so it should be safe for concurrent use.
+type Interceptor func(from, to, text string) Decision
+
+// Interceptors set chain of interceptors called for every MSG in the given order.
+// Every interceptor gets text modified by the previous ones, the chain stops on reject.
+func Interceptors(interceptors ...Interceptor) ServerOpt {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// intercept runs chain of interceptors, it returns text to deliver or false and reason of rejection.
+func (s *Server) intercept(from, to, text string) (string, bool, string) {
+	for _, intercept := range s.interceptors {
+		d := intercept(from, to, text)
+		switch d.Action {
+		case ActionModify:
+			text = d.Text
+		case ActionReject:
+			if d.Reason == "" {
+				d.Reason = "message rejected"
+			}
+			return "", false, d.Reason
+		}
+	}
+	return text, true, ""
+}
+
+// MaxMsgLength returns interceptor rejecting messages longer than n characters.
+func MaxMsgLength(n int) Interceptor {
+	return func(from, to, text string) Decision {
+		if utf8.RuneCountInString(text) > n {
+			return Reject(fmt.Sprintf("message is longer than %d characters", n))
+		}
+		return Deliver()
+	}
+}
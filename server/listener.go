@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// ErrServerStopped is returned when listener is added to stopped server or after StopAccepting.
+var ErrServerStopped = errors.New("server stopped")
+
+// listener accepts connections of the server
+type listener struct {
+	net.Listener
+	codec  highproto.Codec // nil - negotiated per connection
+	closed int32           // set when the listener is closed by the server
+}
+
+// option pattern to configure additional listeners
+
+// ListenerOpt option func
+type ListenerOpt func(l *listener)
+
+// ListenerCodec set codec for all connections of the listener instead of server's one
+func ListenerCodec(codec highproto.Codec) ListenerOpt {
+	return func(l *listener) {
+		l.codec = codec
+	}
+}
+
+// Serve starts accepting connections on additional listener, e.g. Unix domain socket or TLS listener.
+// Clients of all listeners share the same registry so they can send messages to each other.
+// The listener is closed by Stop.
+func (s *Server) Serve(l net.Listener, opts ...ListenerOpt) error {
+	ln := &listener{
+		Listener: l,
+		codec:    s.config.Codec,
+	}
+	for _, opt := range opts {
+		opt(ln)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closing:
+		l.Close()
+		return ErrServerStopped
+	default:
+	}
+
+	s.listeners = append(s.listeners, ln)
+	s.wg.Add(1)
+	go s.serve(ln)
+
+	return nil
+}
+
+// closeListeners closes all listeners so serve goroutines exit and forgets them
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		atomic.StoreInt32(&l.closed, 1)
+		l.Close()
+	}
+}
+
+func (s *Server) serve(l *listener) {
+	defer s.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&l.closed) == 1 {
+				return
+			}
+			s.log.WithError(err).Error("accept error")
+		} else if !s.acceptLimiter.allow(s.config.AcceptRate, conn.RemoteAddr(), time.Now()) {
+			go s.reject(conn, l.codec, "rate limited")
+		} else if !s.admit() {
+			go s.reject(conn, l.codec, "server full")
+		} else {
+			s.wg.Add(1)
+			go func() {
+				c := lowproto.New(conn, lowproto.WriteTimeout(s.config.WriteTimeout))
+				s.handleConnection(c, l.codec)
+				s.wg.Done()
+			}()
+		}
+	}
+}
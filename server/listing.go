@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// maxClientsPage limits amount of names in one page of CLIENTS
+const maxClientsPage = 1000
+
+// listEntry is a line of CLIENTS listing
+type listEntry struct {
+	name string
+	line string // name or status line for verbose listing
+}
+
+// listClients returns clients visible to the requester whose names start with prefix sorted by name
+func (s *Server) listClients(requester *client, prefix string, verbose bool) []listEntry {
+	clients := s.registry.List()
+	entries := make([]listEntry, 0, len(clients))
+	for _, c := range clients {
+		name := c.Name()
+		// the client is registered but its HI isn't completed yet
+		if name == "" || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		cl, local := c.(*client)
+		if local && cl != requester && cl.isHidden() {
+			continue
+		}
+		if !verbose {
+			entries = append(entries, listEntry{name: name, line: name})
+			continue
+		}
+
+		state, text := highproto.StateOnline, ""
+		if local {
+			state, text = cl.status(s.config.AwayTimeout)
+		}
+		entries = append(entries, listEntry{name: name, line: statusLine(name, state, text)})
+	}
+
+	// statuses aren't shared across the cluster
+	if s.cluster != nil {
+		for _, name := range s.cluster.names() {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			line := name
+			if verbose {
+				line = statusLine(name, highproto.StateOnline, "")
+			}
+			entries = append(entries, listEntry{name: name, line: line})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+func joinLines(entries []listEntry) string {
+	var b strings.Builder
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(e.line)
+	}
+	return b.String()
+}
+
+// encodeToken returns continuation token pointing after the name,
+// the token stays valid when clients connect or disconnect
+func encodeToken(name string) string {
+	return highproto.TokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeToken(token string) (name string, ok bool) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, highproto.TokenPrefix))
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// fitsPacket returns true if OK with the param encoded by codec fits into low level packet
+func fitsPacket(codec highproto.Codec, param string) bool {
+	packet, err := codec.Marshal(highproto.Ok{Param: param})
+	return err == nil && len(packet) <= lowproto.MaxPacketSize
+}
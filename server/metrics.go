@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/timsolov/fragmented-tcp/metrics"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// MetricsAddr set address of HTTP listener exposing metrics in Prometheus format on /metrics
+func MetricsAddr(addr string) ServerOpt {
+	return func(s *Server) {
+		s.config.MetricsAddr = addr
+	}
+}
+
+// serverMetrics contains all metrics of the server
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	packets          *metrics.Counter
+	bytes            *metrics.Counter
+	dispatchDuration *metrics.Histogram
+	lowprotoErrors   *metrics.Counter
+	keepAliveMisses  *metrics.Counter
+	rejected         *metrics.Counter
+
+	commands sync.Map // series of commands (map[command]*commandMetrics)
+}
+
+// commandMetrics contains series of a command kept to update them without lookup by labels
+type commandMetrics struct {
+	packetsIn        *metrics.CounterSeries
+	packetsOut       *metrics.CounterSeries
+	bytesIn          *metrics.CounterSeries
+	bytesOut         *metrics.CounterSeries
+	dispatchDuration *metrics.HistogramSeries
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+
+	r.NewGaugeFunc("fragmented_clients_connected", "Amount of connected clients.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(s.conns)
+	})
+	r.NewGaugeFunc("fragmented_clients_authorized", "Amount of clients sent HI.", func() float64 {
+		return float64(len(s.registry.List()))
+	})
+	r.NewGaugeFunc("fragmented_send_queue_depth", "Total amount of packets waiting in send queues of authorized clients.", func() float64 {
+		var depth int
+		for _, cl := range s.localClients() {
+			depth += cl.queueDepth()
+		}
+		return float64(depth)
+	})
+	r.NewGaugeFunc("fragmented_send_queue_max_depth", "Max amount of packets waiting in send queue of authorized client.", func() float64 {
+		var depth int
+		for _, cl := range s.localClients() {
+			if d := cl.queueDepth(); d > depth {
+				depth = d
+			}
+		}
+		return float64(depth)
+	})
+
+	return &serverMetrics{
+		registry:         r,
+		packets:          r.NewCounter("fragmented_packets_total", "Amount of packets by direction and command.", "direction", "command"),
+		bytes:            r.NewCounter("fragmented_bytes_total", "Amount of bytes including length prefix by direction and command.", "direction", "command"),
+		dispatchDuration: r.NewHistogram("fragmented_dispatch_duration_seconds", "Duration of handling commands.", metrics.DefBuckets, "command"),
+		lowprotoErrors:   r.NewCounter("fragmented_lowproto_errors_total", "Amount of errors of reading and writing packets by type.", "error"),
+		keepAliveMisses:  r.NewCounter("fragmented_keepalive_misses_total", "Amount of PING messages which weren't answered by PONG till the next PING."),
+		rejected:         r.NewCounter("fragmented_rejected_connections_total", "Amount of rejected connections by reason.", "reason"),
+	}
+}
+
+// command returns series of the command creating them on first call.
+// Handle calls it to create series of registered commands beforehand.
+func (m *serverMetrics) command(command string) *commandMetrics {
+	if cm, ok := m.commands.Load(command); ok {
+		return cm.(*commandMetrics)
+	}
+	cm, _ := m.commands.LoadOrStore(command, &commandMetrics{
+		packetsIn:        m.packets.With("in", command),
+		packetsOut:       m.packets.With("out", command),
+		bytesIn:          m.bytes.With("in", command),
+		bytesOut:         m.bytes.With("out", command),
+		dispatchDuration: m.dispatchDuration.With(command),
+	})
+	return cm.(*commandMetrics)
+}
+
+func (m *serverMetrics) packetIn(command string, size int) {
+	cm := m.command(command)
+	cm.packetsIn.Inc()
+	cm.bytesIn.Add(float64(size + 2))
+}
+
+func (m *serverMetrics) packetOut(command string, size int) {
+	cm := m.command(command)
+	cm.packetsOut.Inc()
+	cm.bytesOut.Add(float64(size + 2))
+}
+
+func (m *serverMetrics) dispatched(command string, start time.Time) {
+	m.command(command).dispatchDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *serverMetrics) lowprotoError(err error) {
+	var label string
+	switch errors.Cause(err) {
+	case lowproto.ErrTimeout:
+		label = "timeout"
+	case lowproto.ErrBadPacket:
+		label = "bad_packet"
+	case lowproto.ErrEOF:
+		label = "eof"
+	case lowproto.ErrMismatch:
+		label = "mismatch"
+	default:
+		label = "other"
+	}
+	m.lowprotoErrors.Inc(label)
+}
+
+// MetricsHandler returns http.Handler exposing metrics of the server in Prometheus format.
+func (s *Server) MetricsHandler() http.Handler {
+	return s.metrics.registry
+}
+
+// serveMetrics starts HTTP listener of metrics if it's configured.
+func (s *Server) serveMetrics() {
+	if s.config.MetricsAddr == "" {
+		return
+	}
+
+	l, err := net.Listen("tcp", s.config.MetricsAddr)
+	if err != nil {
+		s.log.WithError(err).Fatalf("listen metrics on %s", s.config.MetricsAddr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	s.metricsServer = &http.Server{Handler: mux}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.metricsServer.Serve(l); err != http.ErrServerClosed {
+			s.log.WithError(err).Error("serve metrics")
+		}
+	}()
+	s.log.Infof("metrics are exposed on http://%s/metrics", l.Addr())
+}
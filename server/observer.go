@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// EventKind describes kind of lifecycle event of client.
+type EventKind int
+
+// Kinds of events
+const (
+	EventConnected    EventKind = iota // connection is accepted
+	EventAuthorized                    // client took the name by HI
+	EventRenamed                       // client took another name by HI
+	EventRouted                        // message is delivered to receiver
+	EventRejected                      // message isn't delivered
+	EventDisconnected                  // connection is closed
+)
+
+var eventKinds = [...]string{"connected", "authorized", "renamed", "routed", "rejected", "disconnected"}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventKinds) {
+		return "unknown"
+	}
+	return eventKinds[k]
+}
+
+// Event describes lifecycle event of client.
+type Event struct {
+	Kind       EventKind
+	Time       time.Time
+	RemoteAddr net.Addr
+	Name       string // name of client, the new one for EventRenamed, empty before HI
+	OldName    string // previous name for EventRenamed
+	To         string // receiver for EventRouted and EventRejected
+	Text       string // text of message for EventRouted and EventRejected
+	Reason     string // reason for EventRejected and EventDisconnected
+}
+
+// Observer is notified about lifecycle events of clients.
+// Observe is called synchronously by goroutine handling the connection,
+// so it should be fast and safe for concurrent use.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc is function implementing Observer.
+type ObserverFunc func(e Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// Observers set observers notified about lifecycle events of clients
+func Observers(observers ...Observer) ServerOpt {
+	return func(s *Server) {
+		s.observers = append(s.observers, observers...)
+	}
+}
+
+// notify passes event of client to all observers
+func (s *Server) notify(cl *client, e Event) {
+	if len(s.observers) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	e.RemoteAddr = cl.conn.RemoteAddr()
+	if e.Name == "" {
+		e.Name = cl.Name()
+	}
+	for _, o := range s.observers {
+		o.Observe(e)
+	}
+}
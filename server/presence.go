@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// maxWatched limits amount of names watched by one client
+const maxWatched = 1000
+
+// watchAll is a name subscribing to presence of all clients
+const watchAll = "*"
+
+// Presence notifications sent by SYSTEM to watchers: MSG SYSTEM JOINED <NAME>
+const (
+	presenceJoined = "JOINED"
+	presenceLeft   = "LEFT"
+)
+
+// presence keeps subscriptions of clients to presence of others
+type presence struct {
+	mu       sync.Mutex
+	watchers map[string]map[*client]struct{} // watched name (or *) -> watchers
+	watching map[*client]map[string]struct{} // watcher -> watched names
+}
+
+// registerPresenceCommands registers commands of subscription to presence notifications.
+func (s *Server) registerPresenceCommands() {
+	s.Handle(highproto.WATCH.String(), s.handleWatch, Authorized)
+	s.Handle(highproto.UNWATCH.String(), s.handleUnwatch, Authorized)
+}
+
+// handleWatch subscribes client to JOINED/LEFT notifications about the name
+// or about all clients by *: WATCH <NAME>
+func (s *Server) handleWatch(ctx *Context, params []string) error {
+	name := ctx.Message.(highproto.Watch).Name
+	if name == ctx.Name() {
+		return ctx.Error("not possible to watch yourself")
+	}
+	if !s.presence.watch(ctx.client, name) {
+		return ctx.Error(fmt.Sprintf("not possible to watch more than %d clients", maxWatched))
+	}
+	return ctx.OK(name)
+}
+
+// handleUnwatch cancels subscription: UNWATCH <NAME>
+func (s *Server) handleUnwatch(ctx *Context, params []string) error {
+	name := ctx.Message.(highproto.Unwatch).Name
+	s.presence.unwatch(ctx.client, name)
+	return ctx.OK(name)
+}
+
+// announce notifies watchers of the name and of all clients that the client joined or left.
+// Nothing is sent for hidden clients and to watchers blocked by the client.
+// HIDE is announced as leaving and UNHIDE as joining, so watchers see every client consistently.
+func (s *Server) announce(cl *client, name, event string) {
+	if cl.isHidden() {
+		return
+	}
+	s.sendPresence(cl, name, event)
+}
+
+// sendPresence notifies watchers regardless of hidden flag of the client
+func (s *Server) sendPresence(cl *client, name, event string) {
+	m := highproto.Msg{From: highproto.SYSTEM, Text: event + " " + name}
+	for _, w := range s.presence.watchersOf(name) {
+		if w == cl || cl.blocks(w.Name()) {
+			continue
+		}
+		if err := w.Send(m); err != nil {
+			s.log.WithError(err).Debug("send presence")
+		}
+	}
+}
+
+// watch subscribes the client, it's false when too many names are watched
+func (p *presence) watch(cl *client, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := p.watching[cl]
+	if _, ok := names[name]; ok {
+		return true
+	}
+	if len(names) >= maxWatched {
+		return false
+	}
+
+	if p.watchers == nil {
+		p.watchers = make(map[string]map[*client]struct{})
+		p.watching = make(map[*client]map[string]struct{})
+	}
+	if names == nil {
+		names = make(map[string]struct{})
+		p.watching[cl] = names
+	}
+	names[name] = struct{}{}
+	if p.watchers[name] == nil {
+		p.watchers[name] = make(map[*client]struct{})
+	}
+	p.watchers[name][cl] = struct{}{}
+	return true
+}
+
+func (p *presence) unwatch(cl *client, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remove(cl, name)
+}
+
+// unwatchAll drops all subscriptions of disconnected client
+func (p *presence) unwatchAll(cl *client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name := range p.watching[cl] {
+		p.remove(cl, name)
+	}
+}
+
+// remove should be called under mu
+func (p *presence) remove(cl *client, name string) {
+	delete(p.watchers[name], cl)
+	if len(p.watchers[name]) == 0 {
+		delete(p.watchers, name)
+	}
+	delete(p.watching[cl], name)
+	if len(p.watching[cl]) == 0 {
+		delete(p.watching, cl)
+	}
+}
+
+// watchersOf returns clients watching the name including watchers of all clients
+func (p *presence) watchersOf(name string) []*client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	watchers := make([]*client, 0, len(p.watchers[name])+len(p.watchers[watchAll]))
+	for w := range p.watchers[name] {
+		watchers = append(watchers, w)
+	}
+	for w := range p.watchers[watchAll] {
+		if _, ok := p.watchers[name][w]; !ok {
+			watchers = append(watchers, w)
+		}
+	}
+	return watchers
+}
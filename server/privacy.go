@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// maxBlocked limits amount of clients blocked by one client
+const maxBlocked = 1000
+
+// registerPrivacyCommands registers commands changing privacy settings of client.
+func (s *Server) registerPrivacyCommands() {
+	s.Handle(highproto.BLOCK.String(), s.handleBlock, Authorized)
+	s.Handle(highproto.UNBLOCK.String(), s.handleUnblock, Authorized)
+	s.Handle(highproto.HIDE.String(), s.handleHide, Authorized)
+	s.Handle(highproto.UNHIDE.String(), s.handleUnhide, Authorized)
+}
+
+// handleBlock drops messages from the client: BLOCK <NAME>.
+// The sender isn't notified, it gets OK as if the message is delivered.
+func (s *Server) handleBlock(ctx *Context, params []string) error {
+	name := ctx.Message.(highproto.Block).Name
+	if name == ctx.Name() {
+		return ctx.Error("not possible to block yourself")
+	}
+	if !ctx.client.block(name) {
+		return ctx.Error(fmt.Sprintf("not possible to block more than %d clients", maxBlocked))
+	}
+	return ctx.OK(name)
+}
+
+// handleUnblock delivers messages from the client again: UNBLOCK <NAME>
+func (s *Server) handleUnblock(ctx *Context, params []string) error {
+	name := ctx.Message.(highproto.Unblock).Name
+	ctx.client.unblock(name)
+	return ctx.OK(name)
+}
+
+// handleHide hides the client from CLIENTS listings of others: HIDE.
+// Hidden client is still reachable by MSG.
+func (s *Server) handleHide(ctx *Context, params []string) error {
+	if ctx.client.setHidden(true) {
+		s.sendPresence(ctx.client, ctx.Name(), presenceLeft)
+	}
+	if s.cluster != nil {
+		s.cluster.setHidden(ctx.Name(), true)
+	}
+	return ctx.OK("")
+}
+
+// handleUnhide shows the client in CLIENTS listings again: UNHIDE
+func (s *Server) handleUnhide(ctx *Context, params []string) error {
+	if ctx.client.setHidden(false) {
+		s.announce(ctx.client, ctx.Name(), presenceJoined)
+	}
+	if s.cluster != nil {
+		s.cluster.setHidden(ctx.Name(), false)
+	}
+	return ctx.OK("")
+}
+
+// block adds the name to blocked ones, it's false when too many clients are blocked
+func (c *client) block(name string) bool {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+
+	if c.blocked == nil {
+		c.blocked = make(map[string]struct{})
+	}
+	if _, ok := c.blocked[name]; !ok && len(c.blocked) >= maxBlocked {
+		return false
+	}
+	c.blocked[name] = struct{}{}
+	return true
+}
+
+func (c *client) unblock(name string) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	delete(c.blocked, name)
+}
+
+// blocks returns true if messages from the name are dropped
+func (c *client) blocks(name string) bool {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	_, ok := c.blocked[name]
+	return ok
+}
+
+// setHidden changes hidden flag, it's false when the flag is already set so
+func (c *client) setHidden(hidden bool) bool {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	changed := c.hidden != hidden
+	c.hidden = hidden
+	return changed
+}
+
+func (c *client) isHidden() bool {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	return c.hidden
+}
+
+// blockedBy returns true if the receiver is local client blocking the sender
+func blockedBy(to Client, from string) bool {
+	cl, ok := to.(*client)
+	return ok && cl.blocks(from)
+}
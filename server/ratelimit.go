@@ -0,0 +1,257 @@
+package server
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// ErrRateLimited is returned by dispatch when client exceeded allowed amount of rate limited commands.
+var ErrRateLimited = errors.New("rate limited")
+
+// Rate describes token bucket: PerSecond tokens are added each second up to Burst tokens.
+// Zero Rate means no limit.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// unlimited returns true if rate isn't configured
+func (r Rate) unlimited() bool {
+	return r.PerSecond <= 0 || r.Burst <= 0
+}
+
+// tokenBucket is an implementation of token bucket algorithm.
+type tokenBucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate Rate, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: float64(rate.Burst),
+		last:   now,
+	}
+}
+
+// allow takes one token from bucket if it's possible.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full returns true if bucket is full so it's the same as a new one.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.rate.Burst)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate.PerSecond
+		if b.tokens > float64(b.rate.Burst) {
+			b.tokens = float64(b.rate.Burst)
+		}
+		b.last = now
+	}
+}
+
+// RateLimit set rate limit of the command for each connection
+func RateLimit(command string, perSecond float64, burst int) ServerOpt {
+	return func(s *Server) {
+		if s.config.CommandRates == nil {
+			s.config.CommandRates = make(map[string]Rate)
+		}
+		s.config.CommandRates[command] = Rate{PerSecond: perSecond, Burst: burst}
+	}
+}
+
+// ConnRateLimit set rate limit of all commands for each connection
+func ConnRateLimit(perSecond float64, burst int) ServerOpt {
+	return func(s *Server) {
+		s.config.ConnRate = Rate{PerSecond: perSecond, Burst: burst}
+	}
+}
+
+// DisconnectRateLimited set amount of rate limited commands within a minute after which the client is disconnected
+func DisconnectRateLimited(n int) ServerOpt {
+	return func(s *Server) {
+		s.config.RateLimitedDisconnect = n
+	}
+}
+
+// AcceptRateLimit set rate limit of new connections for each source IP
+func AcceptRateLimit(perSecond float64, burst int) ServerOpt {
+	return func(s *Server) {
+		s.config.AcceptRate = Rate{PerSecond: perSecond, Burst: burst}
+	}
+}
+
+// rateLimited returns true if any rate limit is configured for commands
+func (c Config) rateLimited() bool {
+	return !c.ConnRate.unlimited() || len(c.CommandRates) > 0
+}
+
+// limiter keeps rate limiting state of one connection.
+// It's used only by goroutine handling the connection so it isn't guarded.
+type limiter struct {
+	conn         *tokenBucket
+	commands     map[string]*tokenBucket
+	limited      int       // amount of rate limited commands within window
+	limitedSince time.Time // start of window, time of the first rate limited command in it
+}
+
+// rateLimitedWindow is a duration rate limited commands are counted within to disconnect the client,
+// occasionally limited client isn't disconnected during its whole lifetime.
+const rateLimitedWindow = time.Minute
+
+// hit counts rate limited command and returns amount of them within window.
+func (l *limiter) hit(now time.Time) int {
+	if now.Sub(l.limitedSince) > rateLimitedWindow {
+		l.limited = 0
+		l.limitedSince = now
+	}
+	l.limited++
+	return l.limited
+}
+
+// allow checks both per connection and per command limits.
+func (l *limiter) allow(config Config, command string, now time.Time) bool {
+	if !config.ConnRate.unlimited() {
+		if l.conn == nil {
+			l.conn = newTokenBucket(config.ConnRate, now)
+		}
+		if !l.conn.allow(now) {
+			return false
+		}
+	}
+
+	rate, ok := config.CommandRates[command]
+	if !ok || rate.unlimited() {
+		return true
+	}
+
+	if l.commands == nil {
+		l.commands = make(map[string]*tokenBucket)
+	}
+	b, ok := l.commands[command]
+	if !ok {
+		b = newTokenBucket(rate, now)
+		l.commands[command] = b
+	}
+	return b.allow(now)
+}
+
+// rateLimit is a middleware which limits rate of commands of each connection.
+// PONG isn't limited, it's an answer to PING of the server rather than a request of the client.
+func (s *Server) rateLimit(next HandlerFunc) HandlerFunc {
+	return func(ctx *Context, params []string) error {
+		if ctx.Command() == highproto.PONG.String() {
+			return next(ctx, params)
+		}
+
+		l := &ctx.client.limiter
+		now := time.Now()
+		if l.allow(s.config, ctx.Command(), now) {
+			return next(ctx, params)
+		}
+
+		limited := l.hit(now)
+		if s.config.RateLimitedDisconnect > 0 && limited >= s.config.RateLimitedDisconnect {
+			ctx.Error("rate limited")
+			return errors.Wrapf(ErrRateLimited, "%d commands", limited)
+		}
+		return ctx.Error("rate limited")
+	}
+}
+
+// acceptLimiter limits rate of new connections per source IP. Connections from other addresses,
+// e.g. clients of unix domain socket, don't identify their source so they aren't limited.
+// Full buckets which are the same as new ones are removed once in acceptLimiterSweepInterval
+// and the least recently seen IP is dropped when there are too many of them.
+type acceptLimiter struct {
+	mu      sync.Mutex
+	size    int                      // max amount of tracked IPs, acceptLimiterSize when it's 0
+	buckets map[string]*list.Element // elements of lru by IPs
+	lru     *list.List               // *acceptBucket, the recently seen IP is the first
+	swept   time.Time                // time of the last removal of full buckets
+}
+
+// acceptBucket is a bucket of source IP
+type acceptBucket struct {
+	ip     string
+	bucket *tokenBucket
+}
+
+// acceptLimiterSize is a max amount of tracked IPs by default
+const acceptLimiterSize = 65536
+
+// acceptLimiterSweepInterval is a period of removal of full buckets
+const acceptLimiterSweepInterval = time.Minute
+
+func (l *acceptLimiter) allow(rate Rate, addr net.Addr, now time.Time) bool {
+	if rate.unlimited() {
+		return true
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp == nil {
+		return true
+	}
+	ip := tcp.IP.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*list.Element)
+		l.lru = list.New()
+		l.swept = now
+	}
+
+	if now.Sub(l.swept) > acceptLimiterSweepInterval {
+		l.sweep(now)
+		l.swept = now
+	}
+
+	elem, ok := l.buckets[ip]
+	if ok {
+		l.lru.MoveToFront(elem)
+	} else {
+		size := l.size
+		if size <= 0 {
+			size = acceptLimiterSize
+		}
+		if l.lru.Len() >= size {
+			l.remove(l.lru.Back())
+		}
+		elem = l.lru.PushFront(&acceptBucket{ip: ip, bucket: newTokenBucket(rate, now)})
+		l.buckets[ip] = elem
+	}
+	return elem.Value.(*acceptBucket).bucket.allow(now)
+}
+
+// sweep removes full buckets, mu should be held
+func (l *acceptLimiter) sweep(now time.Time) {
+	for _, elem := range l.buckets {
+		if elem.Value.(*acceptBucket).bucket.full(now) {
+			l.remove(elem)
+		}
+	}
+}
+
+// remove deletes bucket of IP, mu should be held
+func (l *acceptLimiter) remove(elem *list.Element) {
+	delete(l.buckets, elem.Value.(*acceptBucket).ip)
+	l.lru.Remove(elem)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// Client is authorized client kept by Registry.
+type Client interface {
+	// Name returns name the client is registered with.
+	Name() string
+	// Send puts message to send queue of the client without blocking.
+	Send(m highproto.Message) error
+}
+
+// Registry keeps authorized clients by their names.
+// Implementations should be safe for concurrent use.
+type Registry interface {
+	// Register binds the name to the client if the name is free, it's false when the name is taken.
+	// The check and the binding should be atomic so only one of concurrent registrations succeeds.
+	Register(name string, c Client) bool
+	// Unregister removes the name if it's bound to the client.
+	Unregister(name string, c Client)
+	// Lookup returns client bound to the name.
+	Lookup(name string) (Client, bool)
+	// List returns all registered clients in any order.
+	List() []Client
+}
+
+// ClientRegistry set registry of authorized clients instead of default sharded one
+func ClientRegistry(r Registry) ServerOpt {
+	return func(s *Server) {
+		s.registry = r
+	}
+}
+
+// DefaultRegistryShards is amount of shards of registry used by default.
+const DefaultRegistryShards = 64
+
+// memRegistry is in-memory Registry guarded by single lock.
+type memRegistry struct {
+	mu      sync.RWMutex
+	clients map[string]Client
+}
+
+// NewMemRegistry creates in-memory Registry guarded by single lock.
+func NewMemRegistry() Registry {
+	return newMemRegistry()
+}
+
+func newMemRegistry() *memRegistry {
+	return &memRegistry{
+		clients: make(map[string]Client),
+	}
+}
+
+func (r *memRegistry) Register(name string, c Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.clients[name]; ok {
+		return false
+	}
+	r.clients[name] = c
+	return true
+}
+
+func (r *memRegistry) Unregister(name string, c Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients[name] == c {
+		delete(r.clients, name)
+	}
+}
+
+func (r *memRegistry) Lookup(name string) (Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.clients[name]
+	return c, ok
+}
+
+func (r *memRegistry) List() []Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// shardedRegistry spreads clients over in-memory registries by hash of name,
+// so concurrent lookups and registrations of different names rarely wait for each other.
+type shardedRegistry struct {
+	shards []*memRegistry
+}
+
+// NewShardedRegistry creates in-memory Registry of several shards, it's used by default.
+func NewShardedRegistry(shards int) Registry {
+	if shards < 1 {
+		shards = 1
+	}
+	r := &shardedRegistry{
+		shards: make([]*memRegistry, shards),
+	}
+	for i := range r.shards {
+		r.shards[i] = newMemRegistry()
+	}
+	return r
+}
+
+// shard returns shard of the name by FNV-1a hash
+func (r *shardedRegistry) shard(name string) *memRegistry {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return r.shards[h%uint32(len(r.shards))]
+}
+
+func (r *shardedRegistry) Register(name string, c Client) bool {
+	return r.shard(name).Register(name, c)
+}
+
+func (r *shardedRegistry) Unregister(name string, c Client) {
+	r.shard(name).Unregister(name, c)
+}
+
+func (r *shardedRegistry) Lookup(name string) (Client, bool) {
+	return r.shard(name).Lookup(name)
+}
+
+func (r *shardedRegistry) List() []Client {
+	var clients []Client
+	for _, shard := range r.shards {
+		clients = append(clients, shard.List()...)
+	}
+	return clients
+}
+
+// localClients returns registered clients connected to this server.
+func (s *Server) localClients() []*client {
+	list := s.registry.List()
+	clients := make([]*client, 0, len(list))
+	for _, c := range list {
+		if cl, ok := c.(*client); ok {
+			clients = append(clients, cl)
+		}
+	}
+	return clients
+}
@@ -1,113 +1,442 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"strings"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/timsolov/fragmented-tcp/protocols/highproto"
 	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+	"github.com/timsolov/fragmented-tcp/wal"
 )
 
 var Version string
 var Buildtime string
 
-// Server describes tcp listener with gracefull shutdown
+// Server describes tcp listeners with gracefull shutdown
 // it was inspired by this article: https://eli.thegreenplace.net/2020/graceful-shutdown-of-a-tcp-server-in-go/
 type Server struct {
-	listener net.Listener
-	log      *logrus.Entry
-	quit     chan interface{}
-	wg       sync.WaitGroup
-
-	clientNames       map[lowproto.Conn]string // map of client's names (map[socket]name)
-	clientConns       map[string]lowproto.Conn // map to prevent duplication of names and to fast request socket by name
+	config    Config
+	listeners []*listener // guarded by mu
+	log       *logrus.Entry
+	quit      chan interface{}
+	wg        sync.WaitGroup
+	stopOnce  sync.Once
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closing   chan struct{} // closed when the server stops accepting connections
+	started   time.Time
+
+	registry          Registry             // authorized clients by names
+	clients           map[*client]struct{} // set of all connections including not authorized ones
 	mu                sync.RWMutex
 	keepAliveInterval time.Duration
+
+	handlers    map[string]HandlerFunc // map of command handlers (map[command]handler)
+	middlewares []Middleware           // middlewares applied to all commands
+	chains      atomic.Value           // handlers wrapped by middlewares (map[command]handler), read without locking
+	hmu         sync.Mutex             // guards handlers and middlewares
+
+	acceptLimiter acceptLimiter
+	conns         int // amount of connections guarded by mu
+	unauthConns   int // amount of connections which didn't send HI guarded by mu
+
+	metrics       *serverMetrics
+	metricsServer *http.Server
+	adminServer   *http.Server
+	wsServer      *http.Server
+	cluster       *cluster
+	observers     []Observer
+	interceptors  []Interceptor
+	presence      presence
+	history       HistoryStore
+	forgets       map[string]*pendingForget // names which history is dropped after grace period guarded by forgetMu
+	released      []string                  // names released before start, see ReleasedNames
+	forgetMu      sync.Mutex
+	wal           *wal.Log
+}
+
+// Config for create new Server
+type Config struct {
+	// Codec is used for all connections when it's set,
+	// otherwise codec is negotiated by the first packet of each connection.
+	Codec highproto.Codec
+
+	// CommandRates limits rate of each command per connection.
+	CommandRates map[string]Rate
+	// ConnRate limits rate of all commands per connection.
+	ConnRate Rate
+	// RateLimitedDisconnect is an amount of rate limited commands after which client is disconnected, 0 - never.
+	RateLimitedDisconnect int
+	// AcceptRate limits rate of new connections per source IP.
+	AcceptRate Rate
+
+	// MaxConns limits amount of concurrent connections.
+	MaxConns int
+	// MaxUnauthConns limits amount of concurrent connections which didn't send HI yet.
+	MaxUnauthConns int
+	// HiTimeout is a duration after connection during which client should send HI.
+	HiTimeout time.Duration
+	// AwayTimeout is an idle duration after which online client is shown as away, 0 - disabled.
+	AwayTimeout time.Duration
+
+	// SendQueueSize is a max amount of packets waiting to be written to each client.
+	SendQueueSize int
+	// WriteTimeout limits write of each packet to client, the client is disconnected after it, 0 - unlimited.
+	WriteTimeout time.Duration
+	// MetricsAddr is an address of HTTP listener exposing metrics, empty - disabled.
+	MetricsAddr string
+	// AdminAddr is an address of admin HTTP API, empty - disabled.
+	AdminAddr string
+	// AdminToken is a token required by admin HTTP API and by AUTH command.
+	AdminToken string
+	// WebSocketAddr is an address of HTTP listener accepting WebSocket connections, empty - disabled.
+	WebSocketAddr string
+	// WebSocketOrigins are origins of pages allowed to connect WebSocket gateway, empty - any.
+	WebSocketOrigins []string
+	// ClusterAddr is an address of peer link listener, empty - cluster mode is disabled.
+	ClusterAddr string
+	// Peers are addresses of peer link listeners of other nodes of cluster.
+	Peers []string
+	// ClusterSecret is shared by all nodes of cluster to authenticate peer links.
+	ClusterSecret string
+
+	// ShutdownTimeout limits graceful shutdown requested by SHUTDOWN command.
+	ShutdownTimeout time.Duration
+	// HistoryGrace is a duration history of released name is kept for its client to reconnect, 0 - till it expires.
+	HistoryGrace time.Duration
+}
+
+// option pattern to configure Server
+
+// ServerOpt option func
+type ServerOpt func(s *Server)
+
+// Codec set codec for all connections of listeners instead of negotiation
+func Codec(codec highproto.Codec) ServerOpt {
+	return func(s *Server) {
+		s.config.Codec = codec
+	}
+}
+
+// SendQueueSize set max amount of packets waiting to be written to each client
+func SendQueueSize(n int) ServerOpt {
+	return func(s *Server) {
+		s.config.SendQueueSize = n
+	}
+}
+
+// WriteTimeout set timeout of write of each packet to client, 0 - unlimited
+func WriteTimeout(t time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.config.WriteTimeout = t
+	}
+}
+
+// ShutdownTimeout set timeout of graceful shutdown requested by SHUTDOWN command
+func ShutdownTimeout(t time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.config.ShutdownTimeout = t
+	}
 }
 
 // NewServer creates new Server instance
-func NewServer(addr string, log *logrus.Entry) *Server {
+func NewServer(addr string, log *logrus.Entry, opts ...ServerOpt) *Server {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithError(err).Fatalf("listen tcp server on %s", addr)
+	}
+	return NewServerFromListener(l, log, opts...)
+}
+
+// NewServerFromListener creates new Server instance accepting connections on existing listener,
+// e.g. inherited from parent process on upgrade. The listener is closed by Stop.
+func NewServerFromListener(l net.Listener, log *logrus.Entry, opts ...ServerOpt) *Server {
 	s := &Server{
 		quit:              make(chan interface{}),
+		closing:           make(chan struct{}),
+		stopped:           make(chan struct{}),
+		started:           time.Now(),
 		log:               log,
-		clientNames:       make(map[lowproto.Conn]string),
-		clientConns:       make(map[string]lowproto.Conn),
+		registry:          NewShardedRegistry(DefaultRegistryShards),
+		clients:           make(map[*client]struct{}),
 		keepAliveInterval: time.Second * 1,
+		handlers:          make(map[string]HandlerFunc),
+		forgets:           make(map[string]*pendingForget),
+		config: Config{
+			SendQueueSize:   64,
+			WriteTimeout:    time.Second * 10,
+			ShutdownTimeout: time.Second * 10,
+			HistoryGrace:    DefaultHistoryGrace,
+		},
 	}
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		s.log.WithError(err).Fatalf("listen tcp server on %s", addr)
+	s.metrics = newServerMetrics(s)
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.config.rateLimited() {
+		s.Use(s.rateLimit)
+	}
+	s.registerBuiltins()
+	for _, name := range s.released {
+		s.releaseHistory(name)
 	}
-	s.listener = l
-	s.wg.Add(2)
-	go s.serve()
+	s.serveCluster()
+
+	s.wg.Add(1)
 	go s.keepAlive()
+	s.Serve(l)
+	s.serveMetrics()
+	s.serveAdmin()
+	s.serveWebSocket()
 	return s
 }
 
+// Addr returns address of the first listener of the server.
+func (s *Server) Addr() net.Addr {
+	return s.Listener().Addr()
+}
+
+// Listener returns the first listener the server is accepting connections on,
+// i.e. the one passed to NewServerFromListener, created by NewServer or passed to ResumeAccepting.
+// It's nil when the server doesn't accept connections.
+func (s *Server) Listener() net.Listener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Listener
+}
+
 // Stop method to gracefull shutdown tcp listener.
+// It's safe to call Stop several times, each call returns when the server is stopped.
 func (s *Server) Stop() {
-	close(s.quit)
-	s.listener.Close()
-	s.wg.Wait()
+	s.stopOnce.Do(func() {
+		s.shutdown(context.Background(), false)
+	})
+	<-s.stopped
 }
 
-func (s *Server) serve() {
-	defer s.wg.Done()
+// StopGracefully stops accepting connections, notifies all clients by MSG SYSTEM server shutting down
+// and the ones which didn't send HI yet by ERROR server shutting down,
+// flushes their send queues and waits for connections to be closed till the context is done.
+// After that the rest of connections are closed forcibly and the context's error is returned.
+func (s *Server) StopGracefully(ctx context.Context) (err error) {
+	s.stopOnce.Do(func() {
+		err = s.shutdown(ctx, true)
+	})
+	<-s.stopped
+	return err
+}
 
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			select {
-			case <-s.quit:
-				return
-			default:
-				s.log.WithError(err).Error("accept error")
-			}
-		} else {
-			s.wg.Add(1)
-			go func() {
-				c := lowproto.New(conn)
-				s.handleConnection(c)
-				s.wg.Done()
-			}()
+// StopAccepting closes all listeners of the server including metrics, admin, WebSocket and cluster ones,
+// so another process can bind their addresses. Connected clients are served till Stop,
+// but they can't exchange messages with clients of other nodes of cluster anymore.
+func (s *Server) StopAccepting() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closing) // under lock to prevent adding listeners by Serve
+		s.mu.Unlock()
+		s.PauseAccepting()
+		if s.cluster != nil {
+			s.cluster.close()
 		}
+	})
+}
+
+// PauseAccepting closes all listeners of the server including metrics, admin, WebSocket and cluster ones,
+// so another process can bind their addresses, e.g. on upgrade. Connected clients are served meanwhile
+// including messages with clients of other nodes of cluster. Accepting is restored by ResumeAccepting,
+// e.g. when the upgrade fails, or it's stopped for good by StopAccepting or Stop.
+// It shouldn't be called concurrently with ResumeAccepting.
+func (s *Server) PauseAccepting() {
+	s.closeListeners()
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+	if s.wsServer != nil {
+		s.wsServer.Close()
+	}
+	if s.cluster != nil {
+		s.cluster.pause()
+	}
+}
+
+// ResumeAccepting restores accepting connections paused by PauseAccepting: l becomes the first listener
+// and metrics, admin, WebSocket and cluster listeners are opened on their addresses again.
+// Other additional listeners are added by Serve.
+func (s *Server) ResumeAccepting(l net.Listener) error {
+	if err := s.Serve(l); err != nil {
+		return err
+	}
+	if s.cluster != nil {
+		if err := s.cluster.resume(); err != nil {
+			return err
+		}
+	}
+	s.serveMetrics()
+	s.serveAdmin()
+	s.serveWebSocket()
+	return nil
+}
+
+func (s *Server) shutdown(ctx context.Context, notify bool) (err error) {
+	defer close(s.stopped)
+
+	if notify {
+		s.Broadcast("server shutting down")
+		s.notifyUnauthorized("server shutting down")
+	}
+
+	s.StopAccepting()
+	close(s.quit)
+
+	// wake up handlers waiting for packets, they exit flushing send queues
+	s.mu.RLock()
+	for cl := range s.clients {
+		cl.conn.Interrupt()
+	}
+	s.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mu.RLock()
+		for cl := range s.clients {
+			cl.conn.Close()
+		}
+		s.mu.RUnlock()
+		<-done
+		err = ctx.Err()
+	}
+
+	return err
+}
+
+// Done returns channel which is closed when the server is stopped.
+func (s *Server) Done() <-chan struct{} {
+	return s.stopped
+}
+
+// rejectTimeout limits sending of error to rejected connection
+const rejectTimeout = time.Second
+
+// reject sends error to just accepted connection and closes it.
+// It's called in its own goroutine, so the whole exchange including TLS handshake is limited
+// by rejectTimeout to not keep goroutines of connections which don't read.
+func (s *Server) reject(conn net.Conn, codec highproto.Codec, reason string) {
+	defer conn.Close()
+
+	s.metrics.rejected.Inc(reason)
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	cl := newClient(lowproto.New(conn), codec, 0, s.metrics)
+	if err := cl.write(cl.defaultCodec, highproto.Error{Reason: reason}); err != nil {
+		s.log.WithError(err).Debug("reject connection")
 	}
 }
 
-func (s *Server) handleConnection(conn lowproto.Conn) {
+func (s *Server) handleConnection(conn lowproto.Conn, codec highproto.Codec) {
+	cl := newClient(conn, codec, s.config.SendQueueSize, s.metrics)
+	go cl.writeLoop()
+
+	s.mu.Lock()
+	s.clients[cl] = struct{}{}
+	s.mu.Unlock()
+	s.notify(cl, Event{Kind: EventConnected})
+
+	var reason string // reason of disconnection passed to observers
 	defer func() {
+		s.notify(cl, Event{Kind: EventDisconnected, Reason: reason})
+
+		name := cl.Name()
+		authorized := name != ""
+		if authorized {
+			s.registry.Unregister(name, cl)
+		}
+
 		s.mu.Lock()
-		delete(s.clientConns, s.clientNames[conn])
-		delete(s.clientNames, conn)
+		delete(s.clients, cl)
+		if !authorized {
+			s.unauthConns--
+		}
+		s.conns--
 		s.mu.Unlock()
 
+		if authorized && s.cluster != nil {
+			s.cluster.release(name)
+		}
+		if authorized {
+			s.releaseHistory(name)
+		}
+		s.presence.unwatchAll(cl)
+		if authorized {
+			s.announce(cl, name, presenceLeft)
+		}
+
+		close(cl.done)
+		<-cl.flushed
 		conn.Close()
 	}()
 
+	if s.config.HiTimeout > 0 {
+		hiTimer := time.AfterFunc(s.config.HiTimeout, func() {
+			s.dropUnauthorized(cl)
+		})
+		defer hiTimer.Stop()
+	}
+
 ReadLoop:
 	for {
 		select {
 		case <-s.quit:
+			reason = "server stopped"
 			return
 		default:
 			packet, err := conn.ReadPacket()
 			if err != nil {
-				switch errors.Cause(err) {
-				case lowproto.ErrTimeout:
+				// timeout is an idle poll which gives a chance to check quit, it isn't counted as error
+				if errors.Cause(err) == lowproto.ErrTimeout {
 					continue ReadLoop
+				}
+				s.metrics.lowprotoError(err)
+				switch errors.Cause(err) {
+				case lowproto.ErrEOF:
+					reason = "closed by client"
+					return
 				default:
+					if atomic.LoadInt32(&cl.dropped) == 1 {
+						reason, _ = cl.dropReason.Load().(string)
+						return
+					}
+					reason = err.Error()
 					s.log.WithError(err).Error("lowproto reading")
+					return
 				}
 			}
 
-			err = s.dispatch(conn, packet)
+			err = s.dispatch(cl, packet)
 			if err != nil {
+				reason = err.Error()
 				s.log.WithError(err).Error("dispatch message")
 				return
 			}
@@ -123,133 +452,276 @@ func (s *Server) keepAlive() {
 		case <-s.quit:
 			return
 		case <-time.After(s.keepAliveInterval): // once a minute
-			s.mu.RLock()
-			for _, conn := range s.clientConns {
-				go func(conn lowproto.Conn) {
-					conn.WritePacket(
-						[]byte("PING"),
-					)
-				}(conn)
+			for _, cl := range s.localClients() {
+				if !atomic.CompareAndSwapInt32(&cl.awaitingPong, 0, 1) {
+					s.metrics.keepAliveMisses.Inc()
+				}
+				cl.Send(
+					highproto.Ping{},
+				)
 			}
-			s.mu.RUnlock()
 		}
 	}
 }
 
-func (s *Server) dispatch(conn lowproto.Conn, packet []byte) error {
-	kind, params, err := highproto.Parse(packet)
+func (s *Server) dispatch(cl *client, packet []byte) error {
+	cl.received(packet)
+
+	if cl.codec == nil {
+		cl.codec = highproto.Detect(packet)
+	}
+
+	msg, err := cl.codec.Unmarshal(packet)
 	if err != nil {
+		s.metrics.packetIn(highproto.UNKNOWN.String(), len(packet))
 		return errors.Wrap(err, "parse message")
 	}
 
-	var (
-		fromName string
-		ok       bool
-	)
+	command := highproto.Name(msg)
 
-	s.mu.RLock()
-	if fromName, ok = s.clientNames[conn]; !ok && kind != highproto.HI {
-		s.mu.RUnlock()
-		if err = conn.WritePacket(
-			highproto.Response(highproto.ERROR, "HI required"),
-		); err != nil {
-			return fmt.Errorf("writePacket: HI required")
+	h, ok := s.handler(command)
+	if !ok {
+		s.metrics.packetIn(highproto.UNKNOWN.String(), len(packet))
+		return errors.Wrapf(highproto.ErrUnknownPacket, "unexpected %s from client", command)
+	}
+	s.metrics.packetIn(command, len(packet))
+	defer s.metrics.dispatched(command, time.Now())
+
+	// answers on keep alive don't mean the client is active
+	if command != highproto.PONG.String() {
+		cl.touch()
+	}
+
+	return h(&Context{
+		Message: msg,
+		server:  s,
+		client:  cl,
+	}, msg.Params())
+}
+
+// registerBuiltins registers handlers of commands described in the protocol.
+func (s *Server) registerBuiltins() {
+	s.Handle(highproto.HI.String(), s.handleHi)
+	s.Handle(highproto.CLIENTS.String(), s.handleClients, Authorized)
+	s.Handle(highproto.MSG.String(), s.handleMsg, Authorized)
+	s.Handle(highproto.PONG.String(), s.handlePong, Authorized)
+	s.Handle(highproto.STATUS.String(), s.handleStatus, Authorized)
+	s.Handle(highproto.HISTORY.String(), s.handleHistory, Authorized)
+	s.registerPrivacyCommands()
+	s.registerPresenceCommands()
+	s.registerAdminCommands()
+}
+
+func (s *Server) handleHi(ctx *Context, params []string) (err error) {
+	fromName := ctx.Message.(highproto.Hi).Name
+	if fromName == highproto.SYSTEM {
+		if err = ctx.Error("not possible to take SYSTEM name"); err != nil {
+			return fmt.Errorf("writePacket: not possible to take SYSTEM name")
 		}
+
 		return nil
 	}
-	s.mu.RUnlock()
+	if fromName == watchAll {
+		if err = ctx.Error("not possible to take * name"); err != nil {
+			return fmt.Errorf("writePacket: not possible to take * name")
+		}
 
-	switch kind {
-	case highproto.HI:
-		fromName = params[0]
-		if fromName == highproto.SYSTEM {
-			if err = conn.WritePacket(
-				highproto.Response(highproto.ERROR, "not possible to take SYSTEM name"),
-			); err != nil {
-				return fmt.Errorf("writePacket: not possible to take SYSTEM name")
-			}
+		return nil
+	}
 
-			return nil
+	// register user atomically to prevent duplications,
+	// the name of client is changed only when the name is taken cluster-wide
+	oldName := ctx.client.Name()
+	if !s.registry.Register(fromName, ctx.client) {
+		if err = ctx.Error("the name already taken"); err != nil {
+			return fmt.Errorf("writePacket: the name already taken")
 		}
+		return nil
+	}
 
-		// prevent duplications
-		s.mu.RLock()
-		if _, ok = s.clientConns[fromName]; ok {
-			s.mu.RUnlock()
-			if err = conn.WritePacket(
-				highproto.Response(highproto.ERROR, "the name already taken"),
-			); err != nil {
+	// names are unique across the cluster
+	if s.cluster != nil {
+		if err = s.cluster.claim(fromName); err != nil {
+			s.registry.Unregister(fromName, ctx.client)
+			if err = ctx.Error("the name already taken"); err != nil {
 				return fmt.Errorf("writePacket: the name already taken")
 			}
 			return nil
 		}
-		s.mu.RUnlock()
+		if ctx.client.isHidden() {
+			s.cluster.setHidden(fromName, true)
+		}
+	}
 
-		// register user
+	// the first HI races with HI timeout which may drop the client at the same time
+	if oldName == "" && !atomic.CompareAndSwapInt32(&ctx.client.auth, authPending, authDone) {
+		s.registry.Unregister(fromName, ctx.client)
+		if s.cluster != nil {
+			s.cluster.release(fromName)
+		}
+		return fmt.Errorf("HI timeout")
+	}
+	ctx.client.name.Store(fromName)
+	s.keepHistory(fromName)
+
+	// the previous name of client is released
+	if oldName != "" {
+		s.registry.Unregister(oldName, ctx.client)
+		if s.cluster != nil {
+			s.cluster.release(oldName)
+		}
+		s.releaseHistory(oldName)
+		s.notify(ctx.client, Event{Kind: EventRenamed, OldName: oldName})
+		s.announce(ctx.client, oldName, presenceLeft)
+	} else {
 		s.mu.Lock()
-		s.clientNames[conn] = fromName
-		s.clientConns[fromName] = conn
+		s.unauthConns--
 		s.mu.Unlock()
+		s.notify(ctx.client, Event{Kind: EventAuthorized})
+	}
+	s.announce(ctx.client, fromName, presenceJoined)
 
-		if err = conn.WritePacket(
-			highproto.Response(highproto.OK, fromName),
-		); err != nil {
-			return fmt.Errorf("writePacket: OK %s", fromName)
+	if err = ctx.OK(fromName); err != nil {
+		return fmt.Errorf("writePacket: OK %s", fromName)
+	}
+
+	return nil
+}
+
+func (s *Server) handleClients(ctx *Context, params []string) (err error) {
+	m := ctx.Message.(highproto.Clients)
+	entries := s.listClients(ctx.client, m.Prefix, m.Verbose)
+
+	start := m.Offset
+	if m.Token != "" {
+		after, ok := decodeToken(m.Token)
+		if !ok {
+			return ctx.Error("bad continuation token")
 		}
+		start = sort.Search(len(entries), func(i int) bool { return entries[i].name > after })
+	}
+	if start > len(entries) {
+		start = len(entries)
+	}
+	page := entries[start:]
 
-	case highproto.CLIENTS:
-		s.mu.RLock()
-		names := make([]string, 0, len(s.clientNames))
-		for _, name := range s.clientNames {
-			names = append(names, name)
+	// the whole listing is sent when it isn't paginated
+	if m.Limit == 0 {
+		namesParam := joinLines(page)
+		if !fitsPacket(ctx.client.codec, namesParam) {
+			return ctx.Error("too many clients, use CLIENTS [PREFIX] [OFFSET] [LIMIT]")
 		}
-		s.mu.RUnlock()
+		if err = ctx.OK(namesParam); err != nil {
+			return fmt.Errorf("writePacket: OK %s", namesParam)
+		}
+		return nil
+	}
 
-		namesParam := strings.Join(names, "\n")
+	if m.Limit < len(page) {
+		page = page[:m.Limit]
+	}
+	if maxClientsPage < len(page) {
+		page = page[:maxClientsPage]
+	}
+	// page is shortened till it fits into packet
+	for {
+		next := "-"
+		if len(page) > 0 && start+len(page) < len(entries) {
+			next = encodeToken(page[len(page)-1].name)
+		}
+		pageParam := fmt.Sprintf("%d %s", len(entries), next)
+		if len(page) > 0 {
+			pageParam += "\n" + joinLines(page)
+		}
 
-		if err = conn.WritePacket(
-			highproto.Response(highproto.OK, namesParam),
-		); err != nil {
-			return fmt.Errorf("writePacket: OK %s", namesParam)
+		if fitsPacket(ctx.client.codec, pageParam) {
+			if err = ctx.OK(pageParam); err != nil {
+				return fmt.Errorf("writePacket: OK %s", pageParam)
+			}
+			return nil
+		}
+		if len(page) == 1 {
+			return ctx.Error("name of client is too long")
 		}
+		page = page[:len(page)/2]
+	}
+}
 
-	case highproto.MSG:
-		var (
-			to     lowproto.Conn
-			toName string = params[0]
-		)
+func (s *Server) handleMsg(ctx *Context, params []string) (err error) {
+	var (
+		m        = ctx.Message.(highproto.Msg)
+		fromName = ctx.Name()
+		to       Client
+		toName   string = m.To
+		ok       bool
+	)
 
-		s.mu.RLock()
-		if to, ok = s.clientConns[toName]; !ok {
-			s.mu.RUnlock()
+	text, ok, reason := s.intercept(fromName, toName, m.Text)
+	if !ok {
+		s.notify(ctx.client, Event{Kind: EventRejected, To: toName, Text: m.Text, Reason: reason})
+		if err = ctx.Error(reason); err != nil {
+			return fmt.Errorf("writePacket: ERROR %s", reason)
+		}
+		return nil
+	}
 
-			if err = conn.WritePacket(
-				highproto.Response(highproto.ERROR, "unknown receiver of message"),
-			); err != nil {
-				return fmt.Errorf("writePacket: ERROR unknown receiver of message")
+	if to, ok = s.registry.Lookup(toName); !ok {
+		// the receiver may be connected to other node of cluster
+		if s.cluster != nil {
+			if err = s.cluster.route(fromName, toName, text); err == nil {
+				s.notify(ctx.client, Event{Kind: EventRouted, To: toName, Text: text})
+				s.recordDelivered(fromName, toName, text)
+				if err = ctx.OK(toName); err != nil {
+					return fmt.Errorf("writePacket: OK %s", toName)
+				}
+				return nil
 			}
-			return nil
+			s.log.WithError(err).Debug("route message")
 		}
-		s.mu.RUnlock()
 
-		// send to receiver the message
-		if err = to.WritePacket(
-			highproto.Msg(fromName, params[1]),
-		); err != nil {
-			s.log.WithError(err).Error("send message to receiver")
-			return nil
+		s.notify(ctx.client, Event{Kind: EventRejected, To: toName, Text: text, Reason: "unknown receiver of message"})
+		if err = ctx.Error("unknown receiver of message"); err != nil {
+			return fmt.Errorf("writePacket: ERROR unknown receiver of message")
 		}
+		return nil
+	}
 
-		// send response to sender
-		if err = conn.WritePacket(
-			highproto.Response(highproto.OK, toName),
-		); err != nil {
+	// messages from blocked sender are dropped silently
+	if blockedBy(to, fromName) {
+		s.notify(ctx.client, Event{Kind: EventRejected, To: toName, Text: text, Reason: "blocked by receiver"})
+		if err = ctx.OK(toName); err != nil {
 			return fmt.Errorf("writePacket: OK %s", toName)
 		}
+		return nil
+	}
 
-	case highproto.PONG: //skip
+	// send to receiver the message
+	if err = to.Send(
+		highproto.Msg{From: fromName, Text: text},
+	); err != nil {
+		s.log.WithError(err).Error("send message to receiver")
+		reason := "receiver is busy"
+		if err == ErrClientClosed {
+			reason = "unknown receiver of message"
+		}
+		s.notify(ctx.client, Event{Kind: EventRejected, To: toName, Text: text, Reason: reason})
+		if err = ctx.Error(reason); err != nil {
+			return fmt.Errorf("writePacket: ERROR %s", reason)
+		}
 		return nil
 	}
+	s.notify(ctx.client, Event{Kind: EventRouted, To: toName, Text: text})
+	s.recordDelivered(fromName, toName, text)
+
+	// send response to sender
+	if err = ctx.OK(toName); err != nil {
+		return fmt.Errorf("writePacket: OK %s", toName)
+	}
+
+	return nil
+}
 
+func (s *Server) handlePong(ctx *Context, params []string) error {
+	atomic.StoreInt32(&ctx.client.awaitingPong, 0)
 	return nil
 }
@@ -1,12 +1,30 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/timsolov/fragmented-tcp/conf"
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
 	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+	"github.com/timsolov/fragmented-tcp/protocols/wsproto"
+	"github.com/timsolov/fragmented-tcp/wal"
 )
 
 func TestServer(t *testing.T) {
@@ -33,6 +51,38 @@ func TestServer(t *testing.T) {
 		assert.Equal(t, "OK client1", resp)
 	})
 
+	t.Run("custom command", func(t *testing.T) {
+		var handled []string
+		server.Handle("WEATHER", func(ctx *Context, params []string) error {
+			return ctx.OK(ctx.Name() + " asked weather in " + params[0])
+		}, Authorized, func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context, params []string) error {
+				handled = append(handled, ctx.Command())
+				return next(ctx, params)
+			}
+		})
+
+		resp := sendRecv(t, client1, "WEATHER Moscow")
+		assert.Equal(t, "OK client1 asked weather in Moscow", resp)
+		assert.Equal(t, []string{"WEATHER"}, handled)
+	})
+
+	t.Run("global middleware wraps registered commands", func(t *testing.T) {
+		var used []string
+		server.Use(func(next HandlerFunc) HandlerFunc {
+			return func(ctx *Context, params []string) error {
+				if ctx.Command() == "WEATHER" {
+					used = append(used, ctx.Name())
+				}
+				return next(ctx, params)
+			}
+		})
+
+		resp := sendRecv(t, client1, "WEATHER Paris")
+		assert.Equal(t, "OK client1 asked weather in Paris", resp)
+		assert.Equal(t, []string{"client1"}, used)
+	})
+
 	// CLIENT #2
 
 	conn, err = net.Dial("tcp", ":2000")
@@ -62,6 +112,35 @@ func TestServer(t *testing.T) {
 		assert.Equal(t, "MSG client2 Hi client1 !!!", resp)
 	})
 
+	// CLIENT #3 (JSON)
+
+	conn, err = net.Dial("tcp", ":2000")
+	assert.NoError(t, err)
+
+	client3 := lowproto.New(conn)
+	defer client3.Close()
+
+	t.Run("HI client3 in json", func(t *testing.T) {
+		resp := sendRecv(t, client3, `{"type":"HI","name":"client3"}`)
+		assert.Equal(t, `{"type":"OK","param":"client3"}`, resp)
+	})
+
+	t.Run("client3 send message to client1 in json", func(t *testing.T) {
+		resp := sendRecv(t, client3, `{"type":"MSG","to":"client1","text":"Hi from json"}`)
+		assert.Equal(t, `{"type":"OK","param":"client1"}`, resp)
+
+		resp = recv(t, client1)
+		assert.Equal(t, "MSG client3 Hi from json", resp)
+	})
+
+	t.Run("client1 send message to client3", func(t *testing.T) {
+		resp := sendRecv(t, client1, "MSG client3 Hi client3")
+		assert.Equal(t, "OK client3", resp)
+
+		resp = recv(t, client3)
+		assert.Equal(t, `{"type":"MSG","from":"client1","text":"Hi client3"}`, resp)
+	})
+
 	// BROADCASTING TO ALL CLIENTS
 
 	t.Run("wait for broadcasting PING message to all clients from server", func(t *testing.T) {
@@ -89,3 +168,2066 @@ func recv(t *testing.T, client lowproto.Conn) string {
 
 	return string(resp)
 }
+
+func TestServer_RateLimit(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(),
+		RateLimit("CLIENTS", 0.001, 2),
+		DisconnectRateLimited(2),
+		AcceptRateLimit(0.001, 1),
+	)
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	t.Run("CLIENTS is limited", func(t *testing.T) {
+		assert.Equal(t, "OK client1", sendRecv(t, client1, "CLIENTS"))
+		assert.Equal(t, "OK client1", sendRecv(t, client1, "CLIENTS"))
+		assert.Equal(t, "ERROR rate limited", sendRecv(t, client1, "CLIENTS"))
+	})
+
+	t.Run("other commands aren't limited", func(t *testing.T) {
+		assert.Equal(t, "MSG client1 to myself", sendRecv(t, client1, "MSG client1 to myself"))
+		assert.Equal(t, "OK client1", recv(t, client1))
+	})
+
+	t.Run("repeat offender is disconnected", func(t *testing.T) {
+		assert.Equal(t, "ERROR rate limited", sendRecv(t, client1, "CLIENTS"))
+
+		_, err := client1.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+	})
+
+	t.Run("PONG isn't limited", func(t *testing.T) {
+		server := NewServer("127.0.0.1:0", config.LOG(), ConnRateLimit(0.001, 2), DisconnectRateLimited(1))
+		defer server.Stop()
+
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		client := lowproto.New(conn)
+		defer client.Close()
+
+		assert.Equal(t, "OK client", sendRecv(t, client, "HI client"))
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, client.WritePacket([]byte("PONG")))
+		}
+		assert.Equal(t, "OK client", sendRecv(t, client, "CLIENTS"))
+	})
+
+	t.Run("new connections are limited", func(t *testing.T) {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+
+		client2 := lowproto.New(conn)
+		defer client2.Close()
+
+		assert.Equal(t, "ERROR rate limited", recv(t, client2))
+	})
+}
+
+func TestLimiter_Hit(t *testing.T) {
+	var l limiter
+	now := time.Now()
+
+	assert.Equal(t, 1, l.hit(now))
+	assert.Equal(t, 2, l.hit(now.Add(time.Second)))
+	assert.Equal(t, 3, l.hit(now.Add(rateLimitedWindow)))
+
+	// commands are counted again after window
+	now = now.Add(rateLimitedWindow + time.Second)
+	assert.Equal(t, 1, l.hit(now))
+	assert.Equal(t, 2, l.hit(now.Add(time.Second)))
+}
+
+func TestAcceptLimiter(t *testing.T) {
+	l := acceptLimiter{size: 2}
+	rate := Rate{PerSecond: 1, Burst: 1}
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	now := time.Now()
+
+	assert.True(t, l.allow(rate, addr("10.0.0.1"), now))
+	assert.False(t, l.allow(rate, addr("10.0.0.1"), now))
+	assert.True(t, l.allow(rate, addr("10.0.0.2"), now))
+	assert.False(t, l.allow(rate, addr("10.0.0.1"), now))
+
+	// the least recently seen IP is dropped
+	assert.True(t, l.allow(rate, addr("10.0.0.3"), now))
+	assert.Equal(t, 2, len(l.buckets))
+	assert.True(t, l.allow(rate, addr("10.0.0.2"), now))
+	assert.False(t, l.allow(rate, addr("10.0.0.3"), now))
+
+	// full buckets are removed once in interval
+	now = now.Add(acceptLimiterSweepInterval + time.Second)
+	assert.True(t, l.allow(rate, addr("10.0.0.4"), now))
+	assert.Equal(t, 1, len(l.buckets))
+
+	// addresses without IP aren't limited
+	unix := &net.UnixAddr{Name: "@", Net: "unix"}
+	assert.True(t, l.allow(rate, unix, now))
+	assert.True(t, l.allow(rate, unix, now))
+	assert.True(t, l.allow(rate, nil, now))
+	assert.Equal(t, 1, len(l.buckets))
+}
+
+func TestServer_AcceptRateLimitUnix(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(), AcceptRateLimit(0.001, 1))
+	defer server.Stop()
+
+	sock := filepath.Join(t.TempDir(), "server.sock")
+	ul, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Serve(ul))
+
+	// all clients of unix domain socket have the same address, they don't share one limit
+	for _, name := range []string{"first", "second", "third"} {
+		conn, err := net.Dial("unix", sock)
+		assert.NoError(t, err)
+		client := lowproto.New(conn)
+		defer client.Close()
+		assert.Equal(t, "OK "+name, sendRecv(t, client, "HI "+name))
+	}
+}
+
+func TestServer_Admission(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(),
+		MaxConns(2),
+		MaxUnauthConns(1),
+		HiTimeout(time.Millisecond*300),
+	)
+	defer server.Stop()
+
+	dial := func() lowproto.Conn {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		return lowproto.New(conn)
+	}
+
+	client1 := dial()
+	defer client1.Close()
+
+	t.Run("too many unauthorized connections", func(t *testing.T) {
+		client2 := dial()
+		defer client2.Close()
+
+		assert.Equal(t, "ERROR server full", recv(t, client2))
+	})
+
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	client3 := dial()
+	defer client3.Close()
+
+	t.Run("too many connections", func(t *testing.T) {
+		client4 := dial()
+		defer client4.Close()
+
+		assert.Equal(t, "ERROR server full", recv(t, client4))
+	})
+
+	t.Run("HI timeout", func(t *testing.T) {
+		assert.Equal(t, "ERROR HI timeout", recv(t, client3))
+
+		_, err := client3.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+	})
+
+	t.Run("authorized client isn't dropped", func(t *testing.T) {
+		assert.Equal(t, "OK client1", sendRecv(t, client1, "CLIENTS"))
+	})
+
+	t.Run("HI and HI timeout are exclusive", func(t *testing.T) {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+		go io.Copy(io.Discard, peer)
+
+		authorized := newClient(lowproto.New(conn), highproto.Text, 1, server.metrics)
+		atomic.StoreInt32(&authorized.auth, authDone)
+		server.dropUnauthorized(authorized)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&authorized.dropped))
+
+		expired := newClient(lowproto.New(conn), highproto.Text, 1, server.metrics)
+		server.dropUnauthorized(expired)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&expired.dropped))
+		assert.False(t, atomic.CompareAndSwapInt32(&expired.auth, authPending, authDone))
+	})
+}
+
+func TestServer_RejectDoesNotBlockAccept(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(), MaxConns(1))
+	defer server.Stop()
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	assert.NoError(t, err)
+	assert.NoError(t, server.Serve(tl))
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	// rejected connection never does TLS handshake
+	silent, err := net.Dial("tcp", tl.Addr().String())
+	assert.NoError(t, err)
+	defer silent.Close()
+
+	rootCAs := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	dialer := &net.Dialer{Timeout: time.Second * 2, Deadline: time.Now().Add(time.Second * 2)}
+	conn, err = tls.DialWithDialer(dialer, "tcp", tl.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "example.com"})
+	assert.NoError(t, err)
+	client2 := lowproto.New(conn)
+	defer client2.Close()
+	assert.Equal(t, "ERROR server full", recv(t, client2))
+}
+
+func TestServer_Metrics(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "CLIENTS"))
+
+	rec := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "fragmented_clients_connected 1\n")
+	assert.Contains(t, body, "fragmented_clients_authorized 1\n")
+	assert.Contains(t, body, `fragmented_packets_total{direction="in",command="HI"} 1`)
+	assert.Contains(t, body, `fragmented_bytes_total{direction="in",command="CLIENTS"} 9`)
+	assert.Contains(t, body, `fragmented_dispatch_duration_seconds_count{command="CLIENTS"} 1`)
+}
+
+func TestServer_Admin(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	admin := httptest.NewServer(server.AdminHandler("secret"))
+	defer admin.Close()
+
+	request := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	t.Run("wrong token", func(t *testing.T) {
+		resp := request(http.MethodGet, "/clients", "wrong", "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("list clients", func(t *testing.T) {
+		resp := request(http.MethodGet, "/clients", "secret", "")
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var clients []ClientInfo
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&clients))
+		if assert.Len(t, clients, 1) {
+			assert.Equal(t, "client1", clients[0].Name)
+			assert.Equal(t, conn.LocalAddr().String(), clients[0].RemoteAddr)
+			assert.Equal(t, int64(1), clients[0].PacketsIn)
+			assert.Equal(t, int64(len("HI client1")+2), clients[0].BytesIn)
+		}
+	})
+
+	t.Run("broadcast", func(t *testing.T) {
+		resp := request(http.MethodPost, "/broadcast", "secret", `{"text":"hello everyone"}`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		assert.Equal(t, "MSG SYSTEM hello everyone", recv(t, client1))
+	})
+
+	t.Run("log level", func(t *testing.T) {
+		level := server.log.Logger.GetLevel()
+		defer server.log.Logger.SetLevel(level)
+
+		resp := request(http.MethodPut, "/log-level", "secret", `{"level":"warning"}`)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, logrus.WarnLevel, server.log.Logger.GetLevel())
+	})
+
+	t.Run("kick", func(t *testing.T) {
+		resp := request(http.MethodDelete, "/clients/client1?reason=spam", "secret", "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		assert.Equal(t, "MSG SYSTEM kicked: spam", recv(t, client1))
+		_, err := client1.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+
+		resp = request(http.MethodDelete, "/clients/nobody", "secret", "")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServer_KickNotReadingClient(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(), WriteTimeout(0), SendQueueSize(4))
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	// fill socket buffers and send queue, so writes to the client block
+	c, _ := server.registry.Lookup("client1")
+	cl := c.(*client)
+	text := strings.Repeat("x", lowproto.MaxPacketSize-100)
+	for full := 0; full < 20; {
+		if err := cl.Send(highproto.Msg{From: highproto.SYSTEM, Text: text}); err == ErrQueueFull {
+			full++
+			time.Sleep(time.Millisecond * 10)
+		} else {
+			full = 0
+		}
+	}
+
+	start := time.Now()
+	assert.NoError(t, server.Kick("client1", "spam"))
+	assert.True(t, time.Since(start) < time.Millisecond*100, "kick should not wait for the client")
+
+	for i := 0; i < 100; i++ {
+		if _, ok := server.registry.Lookup("client1"); !ok {
+			break
+		}
+		time.Sleep(dropTimeout / 50)
+	}
+	_, ok := server.registry.Lookup("client1")
+	assert.False(t, ok)
+
+	t.Run("closed after timeout when queue isn't full", func(t *testing.T) {
+		conn, peer := net.Pipe()
+		defer peer.Close()
+
+		cl := newClient(lowproto.New(conn), highproto.Text, 4, server.metrics)
+		go cl.writeLoop()
+		defer close(cl.done)
+		assert.NoError(t, cl.Send(highproto.Msg{From: highproto.SYSTEM, Text: "blocked"}))
+
+		start := time.Now()
+		cl.drop(cl.codec, highproto.Msg{From: highproto.SYSTEM, Text: "kicked: spam"}, "kicked: spam")
+		assert.True(t, time.Since(start) < time.Millisecond*100, "kick should not wait for the client")
+
+		// nothing is read from the pipe, so the connection is closed by timeout
+		time.Sleep(dropTimeout + time.Millisecond*100)
+		_, err := peer.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	})
+}
+
+func TestServer_AdminCommands(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(),
+		AdminToken("secret"),
+	)
+	defer server.Stop()
+
+	dial := func() lowproto.Conn {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		return lowproto.New(conn)
+	}
+
+	user := dial()
+	defer user.Close()
+	assert.Equal(t, "OK user", sendRecv(t, user, "HI user"))
+
+	root := dial()
+	defer root.Close()
+	assert.Equal(t, "OK root", sendRecv(t, root, "HI root"))
+
+	t.Run("name doesn't grant role", func(t *testing.T) {
+		assert.Equal(t, "ERROR permission denied", sendRecv(t, root, "STATS"))
+	})
+	assert.Equal(t, "OK admin", sendRecv(t, root, "AUTH secret"))
+
+	t.Run("permission denied", func(t *testing.T) {
+		assert.Equal(t, "ERROR permission denied", sendRecv(t, user, "STATS"))
+	})
+
+	t.Run("AUTH with wrong token", func(t *testing.T) {
+		assert.Equal(t, "ERROR wrong token", sendRecv(t, user, "AUTH wrong"))
+	})
+
+	t.Run("AUTH", func(t *testing.T) {
+		assert.Equal(t, "OK admin", sendRecv(t, user, "AUTH secret"))
+		assert.True(t, strings.HasPrefix(sendRecv(t, user, "STATS"), "OK connections 2\nauthorized 2\n"))
+	})
+
+	t.Run("ANNOUNCE", func(t *testing.T) {
+		assert.Equal(t, "MSG SYSTEM hello everyone", sendRecv(t, root, "ANNOUNCE hello everyone"))
+		assert.Equal(t, "OK ", recv(t, root))
+		assert.Equal(t, "MSG SYSTEM hello everyone", recv(t, user))
+	})
+
+	t.Run("KICK", func(t *testing.T) {
+		assert.Equal(t, "OK user", sendRecv(t, root, "KICK user too many questions"))
+		assert.Equal(t, "MSG SYSTEM kicked: too many questions", recv(t, user))
+	})
+
+	t.Run("SHUTDOWN", func(t *testing.T) {
+		assert.Equal(t, "ERROR seconds should be non-negative integer", sendRecv(t, root, "SHUTDOWN -1"))
+		assert.Equal(t, "ERROR seconds should be up to 86400", sendRecv(t, root, "SHUTDOWN 9223372036"))
+		assert.Equal(t, "MSG SYSTEM server shutting down in 0s", sendRecv(t, root, "SHUTDOWN 0"))
+		assert.Equal(t, "OK 0", recv(t, root))
+
+		select {
+		case <-server.Done():
+		case <-time.After(time.Second * 5):
+			t.Error("server isn't stopped")
+		}
+	})
+}
+
+func TestServer_StopGracefully(t *testing.T) {
+	config := conf.New()
+
+	start := func(t *testing.T) (*Server, lowproto.Conn) {
+		server := NewServer("127.0.0.1:0", config.LOG())
+
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+
+		client := lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+		assert.Equal(t, "OK client1", sendRecv(t, client, "HI client1"))
+
+		return server, client
+	}
+
+	t.Run("clients are notified", func(t *testing.T) {
+		server, client := start(t)
+		defer client.Close()
+
+		// connection which didn't send HI yet
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		pending := lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+		defer pending.Close()
+		for i := 0; i < 100; i++ {
+			server.mu.RLock()
+			n := len(server.clients)
+			server.mu.RUnlock()
+			if n == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		stopped := make(chan error)
+		go func() {
+			stopped <- server.StopGracefully(ctx)
+		}()
+
+		assert.Equal(t, "MSG SYSTEM server shutting down", recv(t, client))
+		_, err = client.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+
+		assert.Equal(t, "ERROR server shutting down", recv(t, pending))
+		_, err = pending.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+		assert.NoError(t, <-stopped)
+	})
+
+	t.Run("connections are closed forcibly after deadline", func(t *testing.T) {
+		server, client := start(t)
+		defer client.Close()
+
+		// the handler holds the connection longer than the deadline
+		waiting, release := make(chan struct{}), make(chan struct{})
+		server.Handle("WAIT", func(ctx *Context, params []string) error {
+			close(waiting)
+			<-release
+			return nil
+		})
+		assert.NoError(t, client.WritePacket([]byte("WAIT")))
+		<-waiting
+		time.AfterFunc(time.Millisecond*200, func() { close(release) })
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		assert.Equal(t, context.DeadlineExceeded, server.StopGracefully(ctx))
+		assert.Equal(t, "MSG SYSTEM server shutting down", recv(t, client))
+	})
+}
+
+func TestNewServerFromListener(t *testing.T) {
+	config := conf.New()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := NewServerFromListener(l, config.LOG())
+	defer server.Stop()
+
+	assert.Equal(t, l, server.Listener())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+}
+
+func TestNewServerFromListener_Inherited(t *testing.T) {
+	config := conf.New()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// the descriptor is duplicated like the one passed to the new process on upgrade
+	f, err := l.(*net.TCPListener).File()
+	assert.NoError(t, err)
+
+	old := NewServerFromListener(l, config.LOG())
+	defer old.Stop()
+
+	dial := func() lowproto.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		return lowproto.New(conn)
+	}
+
+	client1 := dial()
+	defer client1.Close()
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	old.StopAccepting()
+	assert.Equal(t, ErrServerStopped, old.Serve(l))
+
+	// connection coming meanwhile waits in backlog of the socket
+	client2 := dial()
+	defer client2.Close()
+
+	inherited, err := net.FileListener(f)
+	assert.NoError(t, err)
+	f.Close()
+
+	server := NewServerFromListener(inherited, config.LOG())
+	defer server.Stop()
+
+	assert.Equal(t, "OK client2", sendRecv(t, client2, "HI client2"))
+	assert.Equal(t, "OK client2", sendRecv(t, client2, "CLIENTS"))
+
+	// the old server still serves connected clients till it's stopped
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "CLIENTS"))
+}
+
+func TestServer_PauseAccepting(t *testing.T) {
+	config := conf.New()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// the descriptor is duplicated like the one passed to the new process on upgrade
+	f, err := l.(*net.TCPListener).File()
+	assert.NoError(t, err)
+	defer f.Close()
+
+	server := NewServerFromListener(l, config.LOG(), Cluster("127.0.0.1:0"), ClusterSecret("secret"))
+	defer server.Stop()
+
+	dial := func(addr net.Addr) lowproto.Conn {
+		conn, err := net.Dial("tcp", addr.String())
+		assert.NoError(t, err)
+		return lowproto.New(conn)
+	}
+
+	client1 := dial(l.Addr())
+	defer client1.Close()
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+
+	// the upgrade fails, the server resumes accepting on the same socket
+	server.PauseAccepting()
+	assert.Nil(t, server.Listener())
+	_, err = net.Dial("tcp", server.ClusterAddr().String())
+	assert.Error(t, err)
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "CLIENTS"))
+
+	// connection coming meanwhile waits in backlog of the socket
+	client2 := dial(l.Addr())
+	defer client2.Close()
+
+	restored, err := net.FileListener(f)
+	assert.NoError(t, err)
+	assert.NoError(t, server.ResumeAccepting(restored))
+	assert.Equal(t, restored, server.Listener())
+
+	assert.Equal(t, "OK client2", sendRecv(t, client2, "HI client2"))
+	assert.Equal(t, "OK client1\nclient2", sendRecv(t, client1, "CLIENTS"))
+
+	peer := dial(server.ClusterAddr())
+	defer peer.Close()
+	assert.NoError(t, peer.WritePacket([]byte("HELLO peer secret")))
+	assert.True(t, strings.HasPrefix(recv(t, peer), "HELLO "))
+}
+
+func TestServer_Serve(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	// unix domain socket
+	sock := filepath.Join(t.TempDir(), "server.sock")
+	ul, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Serve(ul))
+
+	// TLS with JSON codec, certificate is borrowed from httptest
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	tl, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	assert.NoError(t, err)
+	assert.NoError(t, server.Serve(tl, ListenerCodec(highproto.JSON)))
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	tcpClient := lowproto.New(conn)
+	defer tcpClient.Close()
+
+	conn, err = net.Dial("unix", sock)
+	assert.NoError(t, err)
+	unixClient := lowproto.New(conn)
+	defer unixClient.Close()
+
+	rootCAs := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	conn, err = tls.Dial("tcp", tl.Addr().String(), &tls.Config{RootCAs: rootCAs, ServerName: "example.com"})
+	assert.NoError(t, err)
+	tlsClient := lowproto.New(conn)
+	defer tlsClient.Close()
+
+	assert.Equal(t, "OK tcp", sendRecv(t, tcpClient, "HI tcp"))
+	assert.Equal(t, "OK unix", sendRecv(t, unixClient, "HI unix"))
+	assert.Equal(t, `{"type":"OK","param":"tls"}`, sendRecv(t, tlsClient, `{"type":"HI","name":"tls"}`))
+
+	// all listeners share the same clients registry
+	assert.Equal(t, "OK tcp", sendRecv(t, unixClient, "MSG tcp hello from unix"))
+	assert.Equal(t, "MSG unix hello from unix", recv(t, tcpClient))
+
+	assert.Equal(t, "OK tls", sendRecv(t, tcpClient, "MSG tls hello from tcp"))
+	assert.Equal(t, `{"type":"MSG","from":"tcp","text":"hello from tcp"}`, recv(t, tlsClient))
+
+	server.Stop()
+
+	// listeners can't be added to stopped server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrServerStopped, server.Serve(l))
+}
+
+func TestServer_WebSocket(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	ts := httptest.NewUnstartedServer(nil)
+	wsl := wsproto.NewListener(ts.Listener.Addr())
+	ts.Config.Handler = wsl
+	ts.Start()
+	defer ts.Close()
+	assert.NoError(t, server.Serve(wsl))
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	tcpClient := lowproto.New(conn)
+	defer tcpClient.Close()
+
+	ws, err := wsproto.Dial("ws" + strings.TrimPrefix(ts.URL, "http") + "/chat")
+	assert.NoError(t, err)
+	wsClient := lowproto.New(ws)
+	defer wsClient.Close()
+
+	assert.Equal(t, "OK tcp", sendRecv(t, tcpClient, "HI tcp"))
+	assert.Equal(t, "OK browser", sendRecv(t, wsClient, "HI browser"))
+	assert.Contains(t, sendRecv(t, wsClient, "CLIENTS"), "tcp")
+
+	assert.Equal(t, "OK browser", sendRecv(t, tcpClient, "MSG browser hello from tcp"))
+	assert.Equal(t, "MSG tcp hello from tcp", recv(t, wsClient))
+
+	assert.Equal(t, "OK tcp", sendRecv(t, wsClient, "MSG tcp hello from browser"))
+	assert.Equal(t, "MSG browser hello from browser", recv(t, tcpClient))
+
+	// websocket client leaving is seen by others
+	wsClient.Close()
+	resp := ""
+	for i := 0; i < 40 && resp != "OK tcp"; i++ {
+		time.Sleep(time.Millisecond * 50)
+		resp = sendRecv(t, tcpClient, "CLIENTS")
+	}
+	assert.Equal(t, "OK tcp", resp)
+}
+
+func TestServer_Cluster(t *testing.T) {
+	config := conf.New()
+
+	nodes := make([]*Server, 3)
+	for i := range nodes {
+		nodes[i] = NewServer("127.0.0.1:0", config.LOG(), Cluster("127.0.0.1:0"), ClusterSecret("secret"))
+		defer nodes[i].Stop()
+	}
+	for _, node := range nodes {
+		for _, peer := range nodes {
+			assert.NoError(t, node.AddPeer(peer.ClusterAddr().String()))
+		}
+	}
+	for _, node := range nodes {
+		waitPeers(t, node, len(nodes)-1, 2*(len(nodes)-1))
+	}
+
+	dial := func(node *Server) lowproto.Conn {
+		conn, err := net.Dial("tcp", node.Addr().String())
+		assert.NoError(t, err)
+		return lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+	}
+
+	alice, bob, carol := dial(nodes[0]), dial(nodes[1]), dial(nodes[2])
+	defer alice.Close()
+	defer bob.Close()
+	defer carol.Close()
+
+	t.Run("names are unique cluster-wide", func(t *testing.T) {
+		assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+		assert.Equal(t, "ERROR the name already taken", sendRecv(t, bob, "HI alice"))
+		assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+		assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+
+		assert.Equal(t, "OK alice\nbob\ncarol", sendRecv(t, carol, "CLIENTS"))
+	})
+
+	t.Run("messages are routed to node of receiver", func(t *testing.T) {
+		assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob hi from node 0"))
+		assert.Equal(t, "MSG alice hi from node 0", recv(t, bob))
+
+		assert.Equal(t, "OK alice", sendRecv(t, carol, "MSG alice hi from node 2"))
+		assert.Equal(t, "MSG carol hi from node 2", recv(t, alice))
+
+		assert.Equal(t, "ERROR unknown receiver of message", sendRecv(t, alice, "MSG nobody hi"))
+	})
+
+	t.Run("peers are authenticated", func(t *testing.T) {
+		dialPeer := func(hello string) lowproto.Conn {
+			conn, err := net.Dial("tcp", nodes[1].ClusterAddr().String())
+			assert.NoError(t, err)
+			peer := lowproto.New(conn)
+			assert.NoError(t, peer.WritePacket([]byte(hello)))
+			return peer
+		}
+
+		stranger := dialPeer("HELLO stranger wrong")
+		defer stranger.Close()
+		_, err := stranger.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+
+		// the peer knows the secret but holds no names, it's told names held by the node first
+		peer := dialPeer("HELLO peer secret")
+		defer peer.Close()
+		assert.True(t, strings.HasPrefix(recv(t, peer), "HELLO "))
+		assert.Equal(t, "HAVE bob", recv(t, peer))
+		assert.Equal(t, "ERROR 1 unknown sender of message", sendRecv(t, peer, "ROUTE 1 alice bob fake"))
+		assert.Equal(t, "ERROR 2 unknown sender of message", sendRecv(t, peer, "ROUTE 2 SYSTEM bob fake"))
+		assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob real"))
+		assert.Equal(t, "MSG alice real", recv(t, bob))
+	})
+
+	t.Run("hidden clients aren't listed by other nodes", func(t *testing.T) {
+		waitClients := func(want string) {
+			resp := ""
+			for i := 0; i < 40 && resp != want; i++ {
+				time.Sleep(time.Millisecond * 20)
+				resp = sendRecv(t, carol, "CLIENTS")
+			}
+			assert.Equal(t, want, resp)
+		}
+
+		assert.Equal(t, "OK ", sendRecv(t, alice, "HIDE"))
+		waitClients("OK bob\ncarol")
+		assert.Equal(t, "OK alice", sendRecv(t, carol, "MSG alice still reachable"))
+		assert.Equal(t, "MSG carol still reachable", recv(t, alice))
+
+		assert.Equal(t, "OK ", sendRecv(t, alice, "UNHIDE"))
+		waitClients("OK alice\nbob\ncarol")
+	})
+
+	t.Run("names are released on disconnect", func(t *testing.T) {
+		carol.Close()
+
+		client := dial(nodes[0])
+		defer client.Close()
+		resp := ""
+		for i := 0; i < 40 && resp != "OK carol"; i++ {
+			time.Sleep(time.Millisecond * 50)
+			resp = sendRecv(t, client, "HI carol")
+		}
+		assert.Equal(t, "OK carol", resp)
+	})
+
+	t.Run("names of failed node are released", func(t *testing.T) {
+		nodes[1].Stop()
+
+		client := dial(nodes[2])
+		defer client.Close()
+		resp := ""
+		for i := 0; i < 40 && resp != "OK bob"; i++ {
+			time.Sleep(time.Millisecond * 50)
+			resp = sendRecv(t, client, "HI bob")
+		}
+		assert.Equal(t, "OK bob", resp)
+		assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob are you there?"))
+		assert.Equal(t, "MSG alice are you there?", recv(t, client))
+	})
+}
+
+func TestServer_ClusterAsymmetricPeers(t *testing.T) {
+	config := conf.New()
+
+	nodes := make([]*Server, 2)
+	for i := range nodes {
+		nodes[i] = NewServer("127.0.0.1:0", config.LOG(), Cluster("127.0.0.1:0"), ClusterSecret("secret"))
+		defer nodes[i].Stop()
+	}
+	conn, err := net.Dial("tcp", nodes[1].Addr().String())
+	assert.NoError(t, err)
+	carol := lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+	defer carol.Close()
+	assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+
+	// only the first node knows the peer, the link dialed by it is used in both directions
+	assert.NoError(t, nodes[0].AddPeer(nodes[1].ClusterAddr().String()))
+	for _, node := range nodes {
+		waitPeers(t, node, 1, 1)
+	}
+
+	clients := make([]lowproto.Conn, 2)
+	for i, node := range nodes {
+		conn, err := net.Dial("tcp", node.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+		defer clients[i].Close()
+	}
+	alice, bob := clients[0], clients[1]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "ERROR the name already taken", sendRecv(t, bob, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+
+	// names held before the link is established are announced by accepting node too
+	assert.Equal(t, "OK alice\nbob\ncarol", sendRecv(t, alice, "CLIENTS"))
+	assert.Equal(t, "OK alice\nbob\ncarol", sendRecv(t, bob, "CLIENTS"))
+
+	assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob hi bob"))
+	assert.Equal(t, "MSG alice hi bob", recv(t, bob))
+	assert.Equal(t, "OK alice", sendRecv(t, bob, "MSG alice hi alice"))
+	assert.Equal(t, "MSG bob hi alice", recv(t, alice))
+	assert.Equal(t, "OK carol", sendRecv(t, alice, "MSG carol hi carol"))
+	// carol is connected longer than keep alive interval
+	resp := recv(t, carol)
+	for resp == "PING" {
+		resp = recv(t, carol)
+	}
+	assert.Equal(t, "MSG alice hi carol", resp)
+}
+
+func TestServer_ClusterHistory(t *testing.T) {
+	config := conf.New()
+
+	nodes := make([]*Server, 2)
+	for i := range nodes {
+		nodes[i] = NewServer("127.0.0.1:0", config.LOG(), Cluster("127.0.0.1:0"), ClusterSecret("secret"),
+			MessageHistory(NewMemHistory(10, 0, 0)))
+		defer nodes[i].Stop()
+	}
+	assert.NoError(t, nodes[0].AddPeer(nodes[1].ClusterAddr().String()))
+	assert.NoError(t, nodes[1].AddPeer(nodes[0].ClusterAddr().String()))
+	for _, node := range nodes {
+		waitPeers(t, node, len(nodes)-1, 2*(len(nodes)-1))
+	}
+
+	clients := make([]lowproto.Conn, 2)
+	for i, node := range nodes {
+		conn, err := net.Dial("tcp", node.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+		defer clients[i].Close()
+	}
+	alice, bob := clients[0], clients[1]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+
+	assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob hi bob"))
+	assert.Equal(t, "MSG alice hi bob", recv(t, bob))
+	assert.Equal(t, "OK alice", sendRecv(t, bob, "MSG alice hi alice"))
+	assert.Equal(t, "MSG bob hi alice", recv(t, alice))
+
+	// every message is recorded once by node of sender and once by node of receiver
+	for _, node := range nodes {
+		entries, err := node.history.Range("alice", "bob", 0, 10)
+		assert.NoError(t, err)
+		var got []string
+		for _, e := range entries {
+			got = append(got, fmt.Sprintf("%d %s %s", e.ID, e.From, e.Text))
+		}
+		assert.Equal(t, []string{"1 alice hi bob", "2 bob hi alice"}, got)
+	}
+	assert.NoError(t, bob.WritePacket([]byte("HISTORY alice")))
+	assert.True(t, strings.HasSuffix(recv(t, bob), " alice hi bob"))
+	assert.True(t, strings.HasSuffix(recv(t, bob), " bob hi alice"))
+	assert.Equal(t, "OK 2", recv(t, bob))
+}
+
+// waitPeers waits till the node is connected to n peers by at least links links.
+func waitPeers(t *testing.T, s *Server, n, links int) {
+	for i := 0; i < 100; i++ {
+		s.cluster.mu.Lock()
+		peers, all := len(s.cluster.links), len(s.cluster.all)
+		s.cluster.mu.Unlock()
+		if peers == n && all >= links {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("node isn't connected to %d peers", n)
+}
+
+// fakeRegistry records calls of in-memory registry
+type fakeRegistry struct {
+	Registry
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *fakeRegistry) Register(name string, c Client) bool {
+	// the client keeps its previous name till the new one is registered
+	r.record("Register " + name + " by " + c.Name())
+	return r.Registry.Register(name, c)
+}
+
+func (r *fakeRegistry) Unregister(name string, c Client) {
+	r.record("Unregister " + name)
+	r.Registry.Unregister(name, c)
+}
+
+func (r *fakeRegistry) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *fakeRegistry) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// fakeClient is a client connected somewhere else
+type fakeClient struct {
+	name     string
+	received chan highproto.Message
+}
+
+func (c *fakeClient) Name() string { return c.name }
+
+func (c *fakeClient) Send(m highproto.Message) error {
+	select {
+	case c.received <- m:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+func TestServer_Registry(t *testing.T) {
+	config := conf.New()
+
+	registry := &fakeRegistry{Registry: NewMemRegistry()}
+	remote := &fakeClient{name: "remote", received: make(chan highproto.Message, 1)}
+	registry.Registry.Register(remote.name, remote)
+
+	server := NewServer("127.0.0.1:0", config.LOG(), ClientRegistry(registry))
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client1 := lowproto.New(conn)
+
+	assert.Equal(t, "ERROR the name already taken", sendRecv(t, client1, "HI remote"))
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+	assert.Equal(t, "OK client2", sendRecv(t, client1, "HI client2"))
+
+	resp := sendRecv(t, client1, "CLIENTS")
+	assert.ElementsMatch(t, []string{"client2", "remote"}, strings.Split(strings.TrimPrefix(resp, "OK "), "\n"))
+
+	assert.Equal(t, "OK remote", sendRecv(t, client1, "MSG remote hello"))
+	assert.Equal(t, highproto.Msg{From: "client2", Text: "hello"}, <-remote.received)
+
+	assert.Equal(t, "OK remote", sendRecv(t, client1, "MSG remote one"))
+	assert.Equal(t, "ERROR receiver is busy", sendRecv(t, client1, "MSG remote two"))
+	assert.Equal(t, highproto.Msg{From: "client2", Text: "one"}, <-remote.received)
+
+	client1.Close()
+	for i := 0; i < 40 && len(registry.List()) != 1; i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	assert.Equal(t, []string{
+		"Register remote by ",
+		"Register client1 by ",
+		"Register client2 by client1",
+		"Unregister client1",
+		"Unregister client2",
+	}, registry.recorded())
+}
+
+func TestRegistry(t *testing.T) {
+	registries := map[string]func() Registry{
+		"mem":     NewMemRegistry,
+		"sharded": func() Registry { return NewShardedRegistry(4) },
+	}
+	for name, newRegistry := range registries {
+		t.Run(name, func(t *testing.T) {
+			r := newRegistry()
+			alice := &fakeClient{name: "alice"}
+			bob := &fakeClient{name: "bob"}
+			other := &fakeClient{name: "alice"}
+
+			assert.True(t, r.Register("alice", alice))
+			assert.True(t, r.Register("bob", bob))
+			assert.False(t, r.Register("alice", other))
+			assert.False(t, r.Register("alice", alice))
+			c, ok := r.Lookup("alice")
+			assert.True(t, ok)
+			assert.Equal(t, alice, c)
+			assert.ElementsMatch(t, []Client{alice, bob}, r.List())
+
+			// only own name is removed
+			r.Unregister("alice", other)
+			_, ok = r.Lookup("alice")
+			assert.True(t, ok)
+
+			r.Unregister("alice", alice)
+			_, ok = r.Lookup("alice")
+			assert.False(t, ok)
+			assert.Equal(t, []Client{bob}, r.List())
+		})
+	}
+}
+
+// discardConn is connection writing to nowhere
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Close() error                { return nil }
+
+// BenchmarkServer_Msg measures throughput of concurrent MSG routing among 10k clients.
+func BenchmarkServer_Msg(b *testing.B) {
+	const clients = 10000
+
+	registries := map[string]func() Registry{
+		"mem":     NewMemRegistry,
+		"sharded": func() Registry { return NewShardedRegistry(DefaultRegistryShards) },
+	}
+	for name, newRegistry := range registries {
+		b.Run(name, func(b *testing.B) {
+			log := conf.New().LOG()
+			log.Logger.SetLevel(logrus.ErrorLevel)
+
+			registry := newRegistry()
+			for i := 0; i < clients; i++ {
+				registry.Register(fmt.Sprintf("client%d", i), &nopClient{name: fmt.Sprintf("client%d", i)})
+			}
+
+			server := NewServer("127.0.0.1:0", log, ClientRegistry(registry))
+			defer server.Stop()
+
+			var senders int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := atomic.AddInt64(&senders, 1)
+				cl := newClient(lowproto.New(discardConn{}), highproto.Text, 1024, server.metrics)
+				cl.name.Store(fmt.Sprintf("sender%d", n))
+				registry.Register(cl.Name(), cl)
+				go cl.writeLoop()
+				defer close(cl.done)
+
+				packets := make([][]byte, 64)
+				for i := range packets {
+					packets[i] = []byte(fmt.Sprintf("MSG client%d hello", (int(n)*7919+i*104729)%clients))
+				}
+
+				// OK to sender may be dropped when writeLoop falls behind, it doesn't matter for routing
+				for i := 0; pb.Next(); i++ {
+					server.dispatch(cl, packets[i%len(packets)])
+				}
+			})
+		})
+	}
+}
+
+// nopClient drops all messages
+type nopClient struct {
+	name string
+}
+
+func (c *nopClient) Name() string                   { return c.name }
+func (c *nopClient) Send(m highproto.Message) error { return nil }
+
+// BenchmarkRegistry measures concurrent lookups mixed with registrations like on HI.
+func BenchmarkRegistry(b *testing.B) {
+	const clients = 10000
+
+	registries := map[string]func() Registry{
+		"mem":     NewMemRegistry,
+		"sharded": func() Registry { return NewShardedRegistry(DefaultRegistryShards) },
+	}
+	for name, newRegistry := range registries {
+		b.Run(name, func(b *testing.B) {
+			registry := newRegistry()
+			names := make([]string, clients)
+			for i := range names {
+				names[i] = fmt.Sprintf("client%d", i)
+				registry.Register(names[i], &nopClient{name: names[i]})
+			}
+
+			var seed int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := int(atomic.AddInt64(&seed, 1)) * 7919
+				for i := n; pb.Next(); i++ {
+					name := names[i%clients]
+					if i%10 == 0 {
+						c, _ := registry.Lookup(name)
+						registry.Unregister(name, c)
+						registry.Register(name, c)
+						continue
+					}
+					registry.Lookup(name)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_HiRace(t *testing.T) {
+	const attempts = 100
+
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	clients := make([]lowproto.Conn, attempts)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn, lowproto.ReadLengthTimeout(time.Second*5))
+		defer clients[i].Close()
+	}
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		resps = make([]string, attempts)
+	)
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client lowproto.Conn) {
+			defer wg.Done()
+			<-start
+			if err := client.WritePacket([]byte("HI alice")); err != nil {
+				return
+			}
+			packet, err := client.ReadPacket()
+			if err != nil {
+				return
+			}
+			resps[i] = string(packet)
+		}(i, client)
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, resp := range resps {
+		switch resp {
+		case "OK alice":
+			assert.Equal(t, -1, winner, "more than one winner")
+			winner = i
+		default:
+			assert.Equal(t, "ERROR the name already taken", resp)
+		}
+	}
+	if !assert.NotEqual(t, -1, winner, "no winner") {
+		return
+	}
+
+	// the winner owns the name
+	assert.Equal(t, "OK alice", sendRecv(t, clients[winner], "CLIENTS"))
+	loser := clients[(winner+1)%attempts]
+	assert.Equal(t, "OK bob", sendRecv(t, loser, "HI bob"))
+	assert.Equal(t, "OK alice", sendRecv(t, loser, "MSG alice hello"))
+	assert.Equal(t, "MSG bob hello", recv(t, clients[winner]))
+}
+
+func TestServer_Observers(t *testing.T) {
+	config := conf.New()
+
+	var (
+		mu     sync.Mutex
+		events []Event
+	)
+	observer := ObserverFunc(func(e Event) {
+		assert.NotNil(t, e.RemoteAddr)
+		assert.False(t, e.Time.IsZero())
+		e.Time, e.RemoteAddr = time.Time{}, nil
+
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	// eventsOf returns events of the client by its first name
+	eventsOf := func(name string) []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		var (
+			result []Event
+			names  = map[string]bool{name: true}
+		)
+		for _, e := range events {
+			if e.Kind == EventRenamed && names[e.OldName] {
+				names[e.Name] = true
+			}
+			if names[e.Name] {
+				result = append(result, e)
+			}
+		}
+		return result
+	}
+
+	server := NewServer("127.0.0.1:0", config.LOG(), Observers(observer))
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client1 := lowproto.New(conn)
+	conn, err = net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client2 := lowproto.New(conn)
+	defer client2.Close()
+
+	assert.Equal(t, "OK alice", sendRecv(t, client1, "HI alice"))
+	assert.Equal(t, "OK alice2", sendRecv(t, client1, "HI alice2"))
+	assert.Equal(t, "OK bob", sendRecv(t, client2, "HI bob"))
+	assert.Equal(t, "OK bob", sendRecv(t, client1, "MSG bob hello"))
+	assert.Equal(t, "MSG alice2 hello", recv(t, client2))
+	assert.Equal(t, "ERROR unknown receiver of message", sendRecv(t, client1, "MSG nobody hello"))
+
+	assert.NoError(t, server.Kick("bob", "bye"))
+	client1.Close()
+
+	// disconnection events are sent by goroutines handling connections
+	for i := 0; i < 40; i++ {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n == 9 {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	assert.Equal(t, []Event{
+		{Kind: EventAuthorized, Name: "alice"},
+		{Kind: EventRenamed, Name: "alice2", OldName: "alice"},
+		{Kind: EventRouted, Name: "alice2", To: "bob", Text: "hello"},
+		{Kind: EventRejected, Name: "alice2", To: "nobody", Text: "hello", Reason: "unknown receiver of message"},
+		{Kind: EventDisconnected, Name: "alice2", Reason: "closed by client"},
+	}, eventsOf("alice"))
+	assert.Equal(t, []Event{
+		{Kind: EventAuthorized, Name: "bob"},
+		{Kind: EventDisconnected, Name: "bob", Reason: "kicked: bye"},
+	}, eventsOf("bob"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	var connected int
+	for _, e := range events {
+		if e.Kind == EventConnected {
+			assert.Equal(t, Event{Kind: EventConnected}, e)
+			connected++
+		}
+	}
+	assert.Equal(t, 2, connected)
+	assert.Len(t, events, 9)
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	config := conf.New()
+
+	var calls []string // accessed only by goroutine of client1
+	server := NewServer("127.0.0.1:0", config.LOG(), Interceptors(
+		func(from, to, text string) Decision {
+			calls = append(calls, from+" "+to+" "+text)
+			return Deliver()
+		},
+		MaxMsgLength(20),
+		func(from, to, text string) Decision {
+			if to == "client3" {
+				return Reject("client3 doesn't accept messages")
+			}
+			return Deliver()
+		},
+		func(from, to, text string) Decision {
+			return Modify(strings.Map(func(r rune) rune {
+				if r >= '0' && r <= '9' {
+					return '*'
+				}
+				return r
+			}, text))
+		},
+		func(from, to, text string) Decision {
+			return Modify("[" + text + "]")
+		},
+	))
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client1 := lowproto.New(conn)
+	defer client1.Close()
+	conn, err = net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client2 := lowproto.New(conn)
+	defer client2.Close()
+
+	assert.Equal(t, "OK client1", sendRecv(t, client1, "HI client1"))
+	assert.Equal(t, "OK client2", sendRecv(t, client2, "HI client2"))
+
+	tests := []struct {
+		msg      string
+		wantResp string
+		wantRecv string
+	}{
+		{msg: "MSG client2 hello", wantResp: "OK client2", wantRecv: "MSG client1 [hello]"},
+		{msg: "MSG client2 call me 555-1234", wantResp: "OK client2", wantRecv: "MSG client1 [call me ***-****]"},
+		{msg: "MSG client2 " + strings.Repeat("a", 21), wantResp: "ERROR message is longer than 20 characters"},
+		{msg: "MSG client3 hello", wantResp: "ERROR client3 doesn't accept messages"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			assert.Equal(t, tt.wantResp, sendRecv(t, client1, tt.msg))
+			if tt.wantRecv != "" {
+				assert.Equal(t, tt.wantRecv, recv(t, client2))
+			}
+		})
+	}
+
+	assert.Equal(t, []string{
+		"client1 client2 hello",
+		"client1 client2 call me 555-1234",
+		"client1 client2 " + strings.Repeat("a", 21),
+		"client1 client3 hello",
+	}, calls)
+}
+
+func TestServer_Privacy(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	clients := make([]lowproto.Conn, 3)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob, carol := clients[0], clients[1], clients[2]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+
+	t.Run("block", func(t *testing.T) {
+		assert.Equal(t, "ERROR not possible to block yourself", sendRecv(t, alice, "BLOCK alice"))
+		assert.Equal(t, "OK bob", sendRecv(t, alice, "BLOCK bob"))
+
+		// bob doesn't know he is blocked
+		assert.Equal(t, "OK alice", sendRecv(t, bob, "MSG alice are you there?"))
+		// others are delivered
+		assert.Equal(t, "OK alice", sendRecv(t, carol, "MSG alice hi"))
+		assert.Equal(t, "MSG carol hi", recv(t, alice))
+		// blocking is one way
+		assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob bye"))
+		assert.Equal(t, "MSG alice bye", recv(t, bob))
+
+		assert.Equal(t, "OK bob", sendRecv(t, alice, "UNBLOCK bob"))
+		assert.Equal(t, "OK alice", sendRecv(t, bob, "MSG alice sorry"))
+		assert.Equal(t, "MSG bob sorry", recv(t, alice))
+	})
+
+	t.Run("hide", func(t *testing.T) {
+		listOf := func(client lowproto.Conn) []string {
+			resp := sendRecv(t, client, "CLIENTS")
+			return strings.Split(strings.TrimPrefix(resp, "OK "), "\n")
+		}
+
+		assert.Equal(t, "OK ", sendRecv(t, carol, "HIDE"))
+		assert.ElementsMatch(t, []string{"alice", "bob"}, listOf(alice))
+		assert.ElementsMatch(t, []string{"alice", "bob", "carol"}, listOf(carol))
+
+		// hidden client is reachable
+		assert.Equal(t, "OK carol", sendRecv(t, alice, "MSG carol hi"))
+		assert.Equal(t, "MSG alice hi", recv(t, carol))
+
+		assert.Equal(t, "OK ", sendRecv(t, carol, "UNHIDE"))
+		assert.ElementsMatch(t, []string{"alice", "bob", "carol"}, listOf(alice))
+	})
+}
+
+func TestServer_Presence(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	clients := make([]lowproto.Conn, 4)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob, carol, dave := clients[0], clients[1], clients[2], clients[3]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+
+	assert.Equal(t, "ERROR not possible to take * name", sendRecv(t, bob, "HI *"))
+	assert.Equal(t, "ERROR not possible to watch yourself", sendRecv(t, alice, "WATCH alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, alice, "WATCH bob"))
+	assert.Equal(t, "OK *", sendRecv(t, carol, "WATCH *"))
+
+	// watchers of all clients are notified about everybody
+	assert.Equal(t, "OK dave", sendRecv(t, dave, "HI dave"))
+	assert.Equal(t, "MSG SYSTEM JOINED dave", recv(t, carol))
+
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "MSG SYSTEM JOINED bob", recv(t, alice))
+	assert.Equal(t, "MSG SYSTEM JOINED bob", recv(t, carol))
+
+	// rename is reported as leaving of the old name
+	assert.Equal(t, "OK bobby", sendRecv(t, bob, "HI bobby"))
+	assert.Equal(t, "MSG SYSTEM LEFT bob", recv(t, alice))
+	assert.Equal(t, "MSG SYSTEM LEFT bob", recv(t, carol))
+	assert.Equal(t, "MSG SYSTEM JOINED bobby", recv(t, carol))
+
+	// hiding is reported as leaving, then hidden clients and clients blocking the watcher aren't reported
+	assert.Equal(t, "OK ", sendRecv(t, dave, "HIDE"))
+	assert.Equal(t, "MSG SYSTEM LEFT dave", recv(t, carol))
+	assert.Equal(t, "OK ", sendRecv(t, dave, "HIDE"))
+	assert.Equal(t, "OK ", sendRecv(t, dave, "UNHIDE"))
+	assert.Equal(t, "MSG SYSTEM JOINED dave", recv(t, carol))
+	assert.Equal(t, "OK ", sendRecv(t, dave, "HIDE"))
+	assert.Equal(t, "MSG SYSTEM LEFT dave", recv(t, carol))
+	assert.Equal(t, "OK carol", sendRecv(t, bob, "BLOCK carol"))
+	dave.Close()
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "MSG SYSTEM JOINED bob", recv(t, alice))
+
+	assert.Equal(t, "OK *", sendRecv(t, carol, "UNWATCH *"))
+	assert.Equal(t, "OK bob", sendRecv(t, alice, "UNWATCH bob"))
+	bob.Close()
+	assert.Equal(t, "OK alice", sendRecv(t, carol, "MSG alice hi"))
+	assert.Equal(t, "MSG carol hi", recv(t, alice))
+}
+
+func TestServer_Status(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(), AwayTimeout(time.Millisecond*300))
+	defer server.Stop()
+
+	clients := make([]lowproto.Conn, 3)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob, carol := clients[0], clients[1], clients[2]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+
+	listOf := func(client lowproto.Conn) []string {
+		resp := sendRecv(t, client, "CLIENTS -v")
+		return strings.Split(strings.TrimPrefix(resp, "OK "), "\n")
+	}
+
+	assert.Equal(t, "ERROR unknown status sleeping", sendRecv(t, alice, "STATUS sleeping"))
+	assert.Equal(t, "ERROR status contains forbidden character", sendRecv(t, alice, "STATUS away a\tb"))
+
+	// names with control characters are rejected, they can't forge lines of listing
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	mallory := lowproto.New(conn)
+	defer mallory.Close()
+	assert.NoError(t, mallory.WritePacket([]byte("HI a\tbusy\tfake\nmallory")))
+	_, err = mallory.ReadPacket()
+	assert.Equal(t, lowproto.ErrEOF, err)
+
+	assert.Equal(t, "OK busy", sendRecv(t, alice, "STATUS busy in a meeting"))
+	assert.Equal(t, "OK away", sendRecv(t, bob, "STATUS away"))
+	assert.Equal(t, "OK ", sendRecv(t, carol, "HIDE"))
+	assert.ElementsMatch(t, []string{"alice\tbusy\tin a meeting", "bob\taway\t"}, listOf(alice))
+
+	// online client becomes away when it's idle and online again after any packet
+	assert.Equal(t, "OK online", sendRecv(t, bob, "STATUS online"))
+	time.Sleep(time.Millisecond * 400)
+	assert.ElementsMatch(t, []string{"alice\tbusy\tin a meeting", "bob\taway\t", "carol\tonline\t"}, listOf(carol))
+	assert.Equal(t, "OK alice", sendRecv(t, bob, "MSG alice hi"))
+	assert.Equal(t, "MSG bob hi", recv(t, alice))
+	assert.ElementsMatch(t, []string{"alice\tbusy\tin a meeting", "bob\tonline\t", "carol\tonline\t"}, listOf(carol))
+
+	// plain listing isn't changed
+	assert.Equal(t, "OK ", sendRecv(t, carol, "UNHIDE"))
+	resp := sendRecv(t, alice, "CLIENTS")
+	assert.ElementsMatch(t, []string{"alice", "bob", "carol"}, strings.Split(strings.TrimPrefix(resp, "OK "), "\n"))
+}
+
+func TestServer_ClientsPagination(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	names := []string{"dave", "alice", "bob", "alex", "carol"}
+	clients := make([]lowproto.Conn, len(names))
+	for i, name := range names {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+		assert.Equal(t, "OK "+name, sendRecv(t, clients[i], "HI "+name))
+	}
+	dave := clients[0]
+
+	// listing is sorted
+	assert.Equal(t, "OK alex\nalice\nbob\ncarol\ndave", sendRecv(t, dave, "CLIENTS"))
+	assert.Equal(t, "OK alex\nalice", sendRecv(t, dave, "CLIENTS al"))
+
+	// page contains total and continuation token
+	assert.Equal(t, "OK 5 ~YWxpY2U\nalex\nalice", sendRecv(t, dave, "CLIENTS * 0 2"))
+	assert.Equal(t, "OK 5 ~Ym9i\nbob", sendRecv(t, dave, "CLIENTS * 2 1"))
+	assert.Equal(t, "OK 5 -\ncarol\ndave", sendRecv(t, dave, "CLIENTS * 3 10"))
+	assert.Equal(t, "OK 2 -\nalex\nalice", sendRecv(t, dave, "CLIENTS al 0 10"))
+	assert.Equal(t, "OK 5 -", sendRecv(t, dave, "CLIENTS * 10 10"))
+	assert.Equal(t, "OK 0 -", sendRecv(t, dave, "CLIENTS zed 0 10"))
+
+	// hostile names with control characters aren't taken, so every line of page is a name
+	for _, hi := range []string{"HI a\tbusy\tfake\nmallory", `{"type":"HI","name":"a\nmallory"}`} {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		hostile := lowproto.New(conn)
+		assert.NoError(t, hostile.WritePacket([]byte(hi)))
+		_, err = hostile.ReadPacket()
+		assert.Equal(t, lowproto.ErrEOF, err)
+		hostile.Close()
+	}
+	assert.Equal(t, "OK 5 -\nalex\nalice\nbob\ncarol\ndave", sendRecv(t, dave, "CLIENTS * 0 10"))
+
+	// token stays valid when clients before it disconnect
+	clients[1].Close() // alice
+	for i := 0; i < 100; i++ {
+		if _, ok := server.registry.Lookup("alice"); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, "OK 4 ~Y2Fyb2w\nbob\ncarol", sendRecv(t, dave, "CLIENTS * ~YWxpY2U 2"))
+	assert.Equal(t, "OK 4 -\ndave", sendRecv(t, dave, "CLIENTS * ~Y2Fyb2w 2"))
+	assert.Equal(t, "ERROR bad continuation token", sendRecv(t, dave, "CLIENTS * ~!! 2"))
+
+	assert.Equal(t, "OK 4 ~YWxleA\nalex\tonline\t", sendRecv(t, dave, "CLIENTS -v * 0 1"))
+}
+
+func TestServer_ClientsLarge(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG())
+	defer server.Stop()
+
+	// names which don't fit into one packet
+	for i := 0; i < 5000; i++ {
+		name := fmt.Sprintf("client%04d-%s", i, strings.Repeat("x", 20))
+		server.registry.Register(name, &nopClient{name: name})
+	}
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	client := lowproto.New(conn)
+	defer client.Close()
+	assert.Equal(t, "OK zed", sendRecv(t, client, "HI zed"))
+
+	assert.Equal(t, "ERROR too many clients, use CLIENTS [PREFIX] [OFFSET] [LIMIT]", sendRecv(t, client, "CLIENTS"))
+
+	// the whole listing is received page by page
+	var got []string
+	offset := "0"
+	for offset != "-" {
+		resp := sendRecv(t, client, "CLIENTS * "+offset+" 1000")
+		lines := strings.Split(strings.TrimPrefix(resp, "OK "), "\n")
+		header := strings.Split(lines[0], " ")
+		assert.Equal(t, "5001", header[0])
+		got = append(got, lines[1:]...)
+		offset = header[1]
+	}
+	assert.Len(t, got, 5001)
+	assert.True(t, sort.StringsAreSorted(got))
+}
+
+func TestServer_History(t *testing.T) {
+	config := conf.New()
+
+	server := NewServer("127.0.0.1:0", config.LOG(), MessageHistory(NewMemHistory(3, 0, 0)))
+	defer server.Stop()
+
+	clients := make([]lowproto.Conn, 3)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob, carol := clients[0], clients[1], clients[2]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+
+	exchange := func(from, to lowproto.Conn, fromName, toName, text string) {
+		assert.Equal(t, "OK "+toName, sendRecv(t, from, "MSG "+toName+" "+text))
+		assert.Equal(t, "MSG "+fromName+" "+text, recv(t, to))
+	}
+	exchange(alice, bob, "alice", "bob", "one")
+	exchange(bob, alice, "bob", "alice", "two")
+	exchange(carol, alice, "carol", "alice", "other conversation")
+	exchange(alice, bob, "alice", "bob", "three")
+	exchange(bob, alice, "bob", "alice", "four")
+
+	// entries are sent before OK with their amount, the text is after id, time and sender
+	history := func(client lowproto.Conn, request string) []string {
+		assert.NoError(t, client.WritePacket([]byte(request)))
+		var got []string
+		for {
+			resp := recv(t, client)
+			if !strings.HasPrefix(resp, "ENTRY ") {
+				assert.Equal(t, fmt.Sprintf("OK %d", len(got)), resp)
+				return got
+			}
+			parts := strings.SplitN(resp, " ", 5)
+			got = append(got, parts[1]+" "+parts[3]+" "+parts[4])
+		}
+	}
+
+	// the oldest message is overwritten
+	assert.Equal(t, []string{"2 bob two", "4 alice three", "5 bob four"}, history(bob, "HISTORY alice"))
+	assert.Equal(t, []string{"4 alice three", "5 bob four"}, history(alice, "HISTORY bob 0 2"))
+	assert.Equal(t, []string{"4 alice three"}, history(alice, "HISTORY bob 2 1"))
+	assert.Equal(t, []string{"3 carol other conversation"}, history(alice, "HISTORY carol"))
+	assert.Equal(t, []string(nil), history(bob, "HISTORY carol"))
+
+	// history is kept after disconnection, the reconnected client catches up
+	assert.NoError(t, alice.Close())
+	for i := 0; i < 100; i++ {
+		if _, ok := server.registry.Lookup("alice"); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	conn, err := net.Dial("tcp", server.Addr().String())
+	assert.NoError(t, err)
+	alice = lowproto.New(conn)
+	defer alice.Close()
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, []string{"2 bob two", "4 alice three", "5 bob four"}, history(alice, "HISTORY bob"))
+	assert.Equal(t, []string{"3 carol other conversation"}, history(alice, "HISTORY carol"))
+
+	// history of the name which isn't taken again during grace period is dropped, the next client taking it can't read it
+	short := NewServer("127.0.0.1:0", config.LOG(), MessageHistory(NewMemHistory(3, 0, 0)), HistoryGrace(time.Millisecond*100))
+	defer short.Stop()
+	clients = make([]lowproto.Conn, 3)
+	for i := range clients {
+		conn, err := net.Dial("tcp", short.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob, newAlice := clients[0], clients[1], clients[2]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	exchange(alice, bob, "alice", "bob", "one")
+	assert.Equal(t, "OK alice2", sendRecv(t, alice, "HI alice2"))
+	assert.Equal(t, []string{"1 alice one"}, history(bob, "HISTORY alice"))
+	time.Sleep(time.Millisecond * 300)
+	assert.Equal(t, []string(nil), history(bob, "HISTORY alice"))
+	assert.Equal(t, "OK alice", sendRecv(t, newAlice, "HI alice"))
+	assert.Equal(t, []string(nil), history(newAlice, "HISTORY bob"))
+
+	disabled := NewServer("127.0.0.1:0", config.LOG())
+	defer disabled.Stop()
+	conn, err = net.Dial("tcp", disabled.Addr().String())
+	assert.NoError(t, err)
+	client := lowproto.New(conn)
+	defer client.Close()
+	assert.Equal(t, "OK alice", sendRecv(t, client, "HI alice"))
+	assert.Equal(t, "ERROR history is disabled", sendRecv(t, client, "HISTORY bob"))
+}
+
+func TestServer_HistoryQueue(t *testing.T) {
+	config := conf.New()
+
+	history := NewMemHistory(10, 0, 0)
+	for i := 0; i < 10; i++ {
+		_, err := history.Append(HistoryEntry{Time: time.Now(), From: "bob", To: "alice", Text: strconv.Itoa(i)})
+		assert.NoError(t, err)
+	}
+	server := NewServer("127.0.0.1:0", config.LOG(), MessageHistory(history))
+	defer server.Stop()
+
+	// the queue isn't written, 3 of 8 packets are taken by other messages
+	cl := newClient(lowproto.New(discardConn{}), highproto.Text, 8, server.metrics)
+	cl.name.Store("alice")
+	cl.auth = authDone
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, cl.Send(highproto.Msg{From: "carol", Text: "hi"}))
+	}
+
+	// entries are cut to free space of queue keeping place for OK
+	assert.NoError(t, server.dispatch(cl, []byte("HISTORY bob")))
+	assert.Len(t, cl.out, 8)
+	var got []string
+	for len(cl.out) > 0 {
+		got = append(got, string((<-cl.out).packet))
+	}
+	assert.Equal(t, "OK 4", got[7])
+	assert.True(t, strings.HasSuffix(got[6], " bob 9"), got[6])
+	assert.True(t, strings.HasSuffix(got[3], " bob 6"), got[3])
+}
+
+func TestMemHistory(t *testing.T) {
+	h := NewMemHistory(2, time.Millisecond*200, 0)
+
+	id, err := h.Append(HistoryEntry{Time: time.Now().Add(-time.Second), From: "alice", To: "bob", Text: "expired"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), id)
+
+	// restored entry keeps its id
+	id, err = h.Append(HistoryEntry{ID: 10, Time: time.Now(), From: "bob", To: "alice", Text: "restored"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), id)
+	id, err = h.Append(HistoryEntry{Time: time.Now(), From: "alice", To: "bob", Text: "new"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), id)
+
+	entries, err := h.Range("bob", "alice", 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "restored", entries[0].Text)
+		assert.Equal(t, "new", entries[1].Text)
+	}
+
+	time.Sleep(time.Millisecond * 300)
+	entries, err = h.Range("alice", "bob", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	// history of the name is dropped in all pairs
+	for _, e := range []HistoryEntry{
+		{Time: time.Now(), From: "alice", To: "bob", Text: "one"},
+		{Time: time.Now(), From: "carol", To: "alice", Text: "two"},
+		{Time: time.Now(), From: "bob", To: "carol", Text: "three"},
+	} {
+		_, err = h.Append(e)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, h.Forget("alice"))
+	for _, pair := range [][2]string{{"alice", "bob"}, {"carol", "alice"}} {
+		entries, err = h.Range(pair[0], pair[1], 0, 10)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 0)
+	}
+	entries, err = h.Range("carol", "bob", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMemHistory_Bounds(t *testing.T) {
+	h := NewMemHistory(10, time.Millisecond*200, 2).(*memHistory)
+
+	// ring grows on demand keeping order of entries
+	for i := 1; i <= 12; i++ {
+		_, err := h.Append(HistoryEntry{Time: time.Now(), From: "alice", To: "bob", Text: strconv.Itoa(i)})
+		assert.NoError(t, err)
+		if i == 5 {
+			assert.Len(t, h.pairs[pairKey("alice", "bob")].entries, 8)
+		}
+	}
+	assert.Len(t, h.pairs[pairKey("alice", "bob")].entries, 10)
+	entries, err := h.Range("bob", "alice", 0, 20)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 10) {
+		assert.Equal(t, "3", entries[0].Text)
+		assert.Equal(t, "12", entries[9].Text)
+	}
+
+	// the least recently used pair is evicted
+	_, err = h.Append(HistoryEntry{Time: time.Now(), From: "carol", To: "dave", Text: "one"})
+	assert.NoError(t, err)
+	_, err = h.Append(HistoryEntry{Time: time.Now(), From: "bob", To: "alice", Text: "13"})
+	assert.NoError(t, err)
+	_, err = h.Append(HistoryEntry{Time: time.Now(), From: "erin", To: "carol", Text: "two"})
+	assert.NoError(t, err)
+	assert.Len(t, h.pairs, 2)
+	entries, err = h.Range("carol", "dave", 0, 20)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+	assert.NotContains(t, h.names, "dave")
+	entries, err = h.Range("alice", "bob", 0, 20)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 10)
+
+	// expired pairs are removed
+	time.Sleep(time.Millisecond * 300)
+	_, err = h.Append(HistoryEntry{Time: time.Now(), From: "frank", To: "grace", Text: "three"})
+	assert.NoError(t, err)
+	assert.Len(t, h.pairs, 1)
+	assert.Len(t, h.names, 2)
+	assert.Equal(t, 1, h.lru.Len())
+}
+
+func TestServer_WriteAheadLog(t *testing.T) {
+	config := conf.New()
+	dir := t.TempDir()
+
+	l, err := wal.Open(dir, wal.SyncInterval(0))
+	assert.NoError(t, err)
+
+	server := NewServer("127.0.0.1:0", config.LOG(), MessageHistory(NewMemHistory(10, 0, 0)), WriteAheadLog(l, true),
+		HistoryGrace(time.Millisecond*200))
+
+	clients := make([]lowproto.Conn, 3)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob, carol := clients[0], clients[1], clients[2]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob hi bob"))
+	assert.Equal(t, "MSG alice hi bob", recv(t, bob))
+	assert.Equal(t, "OK bobby", sendRecv(t, bob, "HI bobby"))
+	// history of released name is forgotten when grace period is over
+	time.Sleep(time.Millisecond * 400)
+	assert.Equal(t, "OK alice", sendRecv(t, bob, "MSG alice hi alice"))
+	assert.Equal(t, "MSG bobby hi alice", recv(t, alice))
+	assert.Equal(t, "ERROR unknown receiver of message", sendRecv(t, bob, "MSG carol hi carol"))
+
+	// history of client disconnected during grace period is kept
+	assert.Equal(t, "OK carol", sendRecv(t, carol, "HI carol"))
+	assert.Equal(t, "OK alice", sendRecv(t, carol, "MSG alice hi from carol"))
+	assert.Equal(t, "MSG carol hi from carol", recv(t, alice))
+	carol.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := server.registry.Lookup("carol"); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	server.Stop()
+	assert.NoError(t, l.Close())
+
+	var got []string
+	err = wal.Read(dir, func(r wal.Record) error {
+		switch r.Type {
+		case wal.RecordMsg:
+			got = append(got, fmt.Sprintf("MSG %d %s %s %s", r.ID, r.From, r.To, r.Text))
+		default:
+			got = append(got, r.Type+" "+r.Name)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, got, 12) {
+		assert.Equal(t, []string{
+			"HI alice",
+			"HI bob",
+			"MSG 1 alice bob hi bob",
+			"BYE bob",
+			"HI bobby",
+			"FORGET bob",
+			"MSG 2 bobby alice hi alice",
+			"HI carol",
+			"MSG 3 carol alice hi from carol",
+			"BYE carol",
+		}, got[:10])
+		// clients are disconnected concurrently, history of names released on shutdown is kept
+		assert.ElementsMatch(t, []string{"BYE alice", "BYE bobby"}, got[10:])
+	}
+
+	// history is restored with the same ids
+	history := NewMemHistory(10, 0, 0)
+	n, names, err := RestoreHistory(history, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"alice", "bobby", "carol"}, names)
+	entries, err := history.Range("alice", "bobby", 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, uint64(2), entries[0].ID)
+		assert.Equal(t, "hi alice", entries[0].Text)
+	}
+	entries, err = history.Range("alice", "carol", 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, uint64(3), entries[0].ID)
+	}
+	// history of the forgotten name isn't restored
+	entries, err = history.Range("alice", "bob", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+	id, err := history.Append(HistoryEntry{Time: time.Now(), From: "alice", To: "bobby", Text: "new"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), id)
+}
+
+func TestServer_HistoryRestart(t *testing.T) {
+	config := conf.New()
+	dir := t.TempDir()
+
+	l, err := wal.Open(dir, wal.SyncInterval(0))
+	assert.NoError(t, err)
+	server := NewServer("127.0.0.1:0", config.LOG(), MessageHistory(NewMemHistory(10, 0, 0)), WriteAheadLog(l, false))
+
+	clients := make([]lowproto.Conn, 2)
+	for i := range clients {
+		conn, err := net.Dial("tcp", server.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob := clients[0], clients[1]
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "OK bob", sendRecv(t, alice, "MSG bob hi bob"))
+	assert.Equal(t, "MSG alice hi bob", recv(t, bob))
+
+	// bob is released during grace period, shutdown keeps history of all names
+	bob.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := server.registry.Lookup("bob"); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	server.Stop()
+	assert.NoError(t, l.Close())
+
+	history := NewMemHistory(10, 0, 0)
+	_, names, err := RestoreHistory(history, dir)
+	assert.NoError(t, err)
+	l, err = wal.Open(dir, wal.SyncInterval(0))
+	assert.NoError(t, err)
+	restarted := NewServer("127.0.0.1:0", config.LOG(), MessageHistory(history), HistoryGrace(time.Millisecond*200),
+		ReleasedNames(names...), WriteAheadLog(l, false))
+
+	for i := range clients {
+		conn, err := net.Dial("tcp", restarted.Addr().String())
+		assert.NoError(t, err)
+		clients[i] = lowproto.New(conn)
+		defer clients[i].Close()
+	}
+	alice, bob = clients[0], clients[1]
+
+	// alice takes her name back and catches up, bob doesn't come back during grace period
+	assert.Equal(t, "OK alice", sendRecv(t, alice, "HI alice"))
+	assert.NoError(t, alice.WritePacket([]byte("HISTORY bob")))
+	assert.True(t, strings.HasSuffix(recv(t, alice), " alice hi bob"))
+	assert.Equal(t, "OK 1", recv(t, alice))
+
+	// the next client taking the released name after grace period can't read its history
+	time.Sleep(time.Millisecond * 400)
+	assert.Equal(t, "OK bob", sendRecv(t, bob, "HI bob"))
+	assert.Equal(t, "OK 0", sendRecv(t, bob, "HISTORY alice"))
+
+	// dropping is logged, so the next restart doesn't restore it
+	restarted.Stop()
+	assert.NoError(t, l.Close())
+	var forgotten []string
+	err = wal.Read(dir, func(r wal.Record) error {
+		if r.Type == wal.RecordForget {
+			forgotten = append(forgotten, r.Name)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, forgotten)
+	n, names, err := RestoreHistory(NewMemHistory(10, 0, 0), dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"alice"}, names)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/timsolov/fragmented-tcp/protocols/highproto"
+)
+
+// maxStatusLength limits amount of characters in text of status
+const maxStatusLength = 140
+
+// AwayTimeout set idle duration after which online client is shown as away, 0 - disabled.
+// Idle time is measured from the last packet received from the client except PONG.
+func AwayTimeout(t time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.config.AwayTimeout = t
+	}
+}
+
+// handleStatus sets status of the client: STATUS <online|away|busy> [TEXT]
+func (s *Server) handleStatus(ctx *Context, params []string) error {
+	m := ctx.Message.(highproto.Status)
+	switch m.State {
+	case highproto.StateOnline, highproto.StateAway, highproto.StateBusy:
+	default:
+		return ctx.Error("unknown status " + m.State)
+	}
+	if strings.ContainsAny(m.Text, "\t\n") {
+		return ctx.Error("status contains forbidden character")
+	}
+	if utf8.RuneCountInString(m.Text) > maxStatusLength {
+		return ctx.Error(fmt.Sprintf("status is longer than %d characters", maxStatusLength))
+	}
+
+	ctx.client.setStatus(m.State, m.Text)
+	return ctx.OK(m.State)
+}
+
+// statusLine formats line of verbose CLIENTS listing: <NAME>\t<STATE>\t<TEXT>
+func statusLine(name, state, text string) string {
+	return name + "\t" + state + "\t" + text
+}
+
+func (c *client) setStatus(state, text string) {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	c.state, c.stateText = state, text
+}
+
+// status returns status set by the client, online client idle longer than awayTimeout is away
+func (c *client) status(awayTimeout time.Duration) (state, text string) {
+	c.pmu.Lock()
+	state, text = c.state, c.stateText
+	c.pmu.Unlock()
+
+	if state == "" {
+		state = highproto.StateOnline
+	}
+	if state == highproto.StateOnline && awayTimeout > 0 && c.idle() > awayTimeout {
+		state = highproto.StateAway
+	}
+	return state, text
+}
+
+// touch marks the client active
+func (c *client) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idle returns duration since the last activity of the client
+func (c *client) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/timsolov/fragmented-tcp/wal"
+)
+
+// WriteAheadLog set log where every delivered MSG is appended, with events HI and BYE records
+// are appended too when clients take and release names. The log isn't closed by the server.
+// Messages are appended right after delivery rather than ahead of it, so the log never contains
+// rejected messages, but the last delivered ones may be lost on crash.
+func WriteAheadLog(l *wal.Log, events bool) ServerOpt {
+	return func(s *Server) {
+		s.wal = l
+		if events {
+			s.observers = append(s.observers, walObserver{s: s})
+		}
+	}
+}
+
+// RestoreHistory appends messages from the log in the directory to the store
+// and returns amount of restored messages and names which exchanged them,
+// history of names forgotten after grace period is dropped. It's called before the server is started,
+// the names should be passed to it by ReleasedNames so their history is dropped after grace period again.
+func RestoreHistory(store HistoryStore, dir string) (int, []string, error) {
+	var n int
+	names := make(map[string]struct{})
+	err := wal.Read(dir, func(r wal.Record) error {
+		if r.Type == wal.RecordForget {
+			delete(names, r.Name)
+			return store.Forget(r.Name)
+		}
+		if r.Type != wal.RecordMsg {
+			return nil
+		}
+		if _, err := store.Append(HistoryEntry{ID: r.ID, Time: r.Time, From: r.From, To: r.To, Text: r.Text}); err != nil {
+			return err
+		}
+		names[r.From] = struct{}{}
+		names[r.To] = struct{}{}
+		n++
+		return nil
+	})
+
+	restored := make([]string, 0, len(names))
+	for name := range names {
+		restored = append(restored, name)
+	}
+	sort.Strings(restored)
+	return n, restored, err
+}
+
+// logMessage appends delivered message to write-ahead log if it's enabled
+func (s *Server) logMessage(e HistoryEntry) {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.Append(wal.Record{
+		Type: wal.RecordMsg,
+		ID:   e.ID,
+		Time: e.Time,
+		From: e.From,
+		To:   e.To,
+		Text: e.Text,
+	}); err != nil {
+		s.log.WithError(err).Error("append message to write-ahead log")
+	}
+}
+
+// logForget appends dropping of history of the name to write-ahead log if it's enabled
+func (s *Server) logForget(name string) {
+	if s.wal == nil {
+		return
+	}
+	if err := s.wal.Append(wal.Record{Type: wal.RecordForget, Time: time.Now(), Name: name}); err != nil {
+		s.log.WithError(err).Error("append forget to write-ahead log")
+	}
+}
+
+// walObserver appends taking and releasing of names to write-ahead log
+type walObserver struct {
+	s *Server
+}
+
+func (o walObserver) Observe(e Event) {
+	switch e.Kind {
+	case EventAuthorized:
+		o.append(wal.Record{Type: wal.RecordHi, Time: e.Time, Name: e.Name})
+	case EventRenamed:
+		o.append(wal.Record{Type: wal.RecordBye, Time: e.Time, Name: e.OldName})
+		o.append(wal.Record{Type: wal.RecordHi, Time: e.Time, Name: e.Name})
+	case EventDisconnected:
+		if e.Name != "" {
+			o.append(wal.Record{Type: wal.RecordBye, Time: e.Time, Name: e.Name})
+		}
+	}
+}
+
+func (o walObserver) append(r wal.Record) {
+	if err := o.s.wal.Append(r); err != nil {
+		o.s.log.WithError(err).Error("append event to write-ahead log")
+	}
+}
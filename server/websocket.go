@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/timsolov/fragmented-tcp/protocols/wsproto"
+)
+
+// WebSocketAddr set address of HTTP listener accepting WebSocket connections on any path.
+// Every WebSocket message is one packet so browsers use the same high level protocol.
+func WebSocketAddr(addr string) ServerOpt {
+	return func(s *Server) {
+		s.config.WebSocketAddr = addr
+	}
+}
+
+// WebSocketOrigins set origins of pages allowed to connect WebSocket gateway, e.g. https://example.com.
+// Any origin is allowed by default.
+func WebSocketOrigins(origins ...string) ServerOpt {
+	return func(s *Server) {
+		s.config.WebSocketOrigins = append(s.config.WebSocketOrigins, origins...)
+	}
+}
+
+// serveWebSocket starts HTTP listener of WebSocket gateway if it's configured.
+// Upgraded connections are served as any other listener's ones.
+func (s *Server) serveWebSocket() {
+	if s.config.WebSocketAddr == "" {
+		return
+	}
+
+	l, err := net.Listen("tcp", s.config.WebSocketAddr)
+	if err != nil {
+		s.log.WithError(err).Fatalf("listen websocket on %s", s.config.WebSocketAddr)
+	}
+
+	var opts []wsproto.UpgradeOpt
+	if len(s.config.WebSocketOrigins) > 0 {
+		opts = append(opts, wsproto.AllowedOrigins(s.config.WebSocketOrigins...))
+	}
+	wsl := wsproto.NewListener(l.Addr(), opts...)
+	s.wsServer = &http.Server{Handler: wsl}
+	s.Serve(wsl)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.wsServer.Serve(l); err != http.ErrServerClosed {
+			s.log.WithError(err).Error("serve websocket")
+		}
+	}()
+	s.log.Infof("websocket gateway is running on ws://%s", l.Addr())
+}
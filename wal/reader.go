@@ -0,0 +1,132 @@
+package wal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// followInterval is a period of checking new records by Follow
+const followInterval = time.Millisecond * 100
+
+// Read calls fn for every record of the log in the directory in order of writing till the end of log.
+// Truncated record at the end of segment, e.g. after crash, and corrupted records are skipped.
+// Error of fn stops reading.
+func Read(dir string, fn func(Record) error) error {
+	r := &reader{dir: dir}
+	defer r.close()
+
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// Follow calls fn for every record like Read and then waits for new records till ctx is done.
+func Follow(ctx context.Context, dir string, fn func(Record) error) error {
+	r := &reader{dir: dir}
+	defer r.close()
+
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(followInterval):
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// reader reads records segment by segment
+type reader struct {
+	dir    string
+	index  uint64   // number of current segment
+	f      *os.File // current segment, nil till the first segment is found
+	offset int64    // offset of the next record in current segment
+}
+
+// next returns the next record or io.EOF when there are no more records yet
+func (r *reader) next() (Record, error) {
+	for {
+		if r.f == nil {
+			ok, err := r.openNext()
+			if err != nil || !ok {
+				return Record{}, err
+			}
+		}
+
+		packet, err := lowproto.ReadFrame(r.f)
+		if err == nil {
+			r.offset += int64(len(packet)) + 2
+
+			var rec Record
+			if err := json.Unmarshal(packet, &rec); err != nil {
+				continue // corrupted record
+			}
+			return rec, nil
+		}
+		if err != lowproto.ErrEOF && errors.Cause(err) != lowproto.ErrBadPacket {
+			return Record{}, errors.Wrapf(err, "read segment %d", r.index)
+		}
+
+		// the record may be still written, so it's read again later unless the log continues in the next segment
+		if _, err := r.f.Seek(r.offset, io.SeekStart); err != nil {
+			return Record{}, errors.Wrapf(err, "seek segment %d", r.index)
+		}
+		ok, err := r.openNext()
+		if err != nil || !ok {
+			return Record{}, err
+		}
+	}
+}
+
+// openNext switches to the segment following current one, it's false when there is no one
+func (r *reader) openNext() (bool, error) {
+	indexes, err := segments(r.dir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, index := range indexes {
+		if r.f != nil && index <= r.index {
+			continue
+		}
+		f, err := os.Open(segmentPath(r.dir, index))
+		if err != nil {
+			return false, errors.Wrap(err, "open segment")
+		}
+		r.close()
+		r.f, r.index, r.offset = f, index, 0
+		return true, nil
+	}
+	return false, io.EOF
+}
+
+func (r *reader) close() {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
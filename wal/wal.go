@@ -0,0 +1,295 @@
+// Package wal implements append-only log of messages stored in segment files.
+// Every record is a JSON object framed by lowproto length prefix, so a record is limited by 64KB.
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+// Types of records
+const (
+	RecordMsg    = "MSG"    // message delivered From To
+	RecordHi     = "HI"     // client took the Name
+	RecordBye    = "BYE"    // client released the Name
+	RecordForget = "FORGET" // history of the Name is dropped
+)
+
+// Record is an entry of the log.
+type Record struct {
+	Type string    `json:"type"`
+	ID   uint64    `json:"id,omitempty"` // id of message in history, 0 - history is disabled
+	Time time.Time `json:"time"`
+	Name string    `json:"name,omitempty"`
+	From string    `json:"from,omitempty"`
+	To   string    `json:"to,omitempty"`
+	Text string    `json:"text,omitempty"`
+}
+
+// ErrClosed is returned by Append after Close.
+var ErrClosed = errors.New("log closed")
+
+// DefaultSegmentSize is a max size of segment file used when it isn't set.
+const DefaultSegmentSize = 64 << 20
+
+// segmentExt is extension of segment files, names of segments are their zero padded numbers
+const segmentExt = ".wal"
+
+// Config for open Log
+type Config struct {
+	// SegmentSize is a max size of segment file in bytes, the log continues in the next segment after it.
+	SegmentSize int64
+	// SyncInterval is a period of fsync of written records, 0 - after every record,
+	// negative - on rotation of segment and Close only.
+	SyncInterval time.Duration
+	// MaxSegments is a max amount of segments kept in the directory, the oldest ones are removed
+	// when the next segment is started, 0 - unlimited.
+	MaxSegments int
+}
+
+// Opt option func
+type Opt func(l *Log)
+
+// SegmentSize set max size of segment file in bytes
+func SegmentSize(n int64) Opt {
+	return func(l *Log) {
+		l.config.SegmentSize = n
+	}
+}
+
+// SyncInterval set period of fsync, 0 - after every record, negative - on rotation and Close only
+func SyncInterval(d time.Duration) Opt {
+	return func(l *Log) {
+		l.config.SyncInterval = d
+	}
+}
+
+// MaxSegments set max amount of segments kept in the directory, 0 - unlimited
+func MaxSegments(n int) Opt {
+	return func(l *Log) {
+		l.config.MaxSegments = n
+	}
+}
+
+// Log is append-only log safe for concurrent use.
+// Every opened Log writes new segments, so records of another process using the same
+// directory, e.g. during upgrade, are never overwritten.
+type Log struct {
+	config Config
+	dir    string
+
+	mu     sync.Mutex
+	f      *os.File // current segment, nil till the first record
+	index  uint64   // number of current segment
+	size   int64    // size of current segment
+	dirty  bool     // there are records which aren't synced
+	closed bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Open opens log in the directory creating it if it's needed.
+func Open(dir string, opts ...Opt) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create log directory")
+	}
+
+	l := &Log{
+		config: Config{
+			SegmentSize:  DefaultSegmentSize,
+			SyncInterval: time.Second,
+		},
+		dir:  dir,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.config.SegmentSize <= 0 {
+		l.config.SegmentSize = DefaultSegmentSize
+	}
+
+	segments, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		l.index = segments[len(segments)-1]
+	}
+
+	if l.config.SyncInterval > 0 {
+		go l.syncLoop()
+	} else {
+		close(l.done)
+	}
+	return l, nil
+}
+
+// Append writes record to the end of log
+func (l *Log) Append(r Record) error {
+	packet, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "marshal record")
+	}
+	if len(packet) > lowproto.MaxPacketSize {
+		return errors.Wrapf(lowproto.ErrTooLarge, "record of %d bytes", len(packet))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	if l.f == nil || l.size+int64(len(packet))+2 > l.config.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := lowproto.WriteFrame(l.f, packet); err != nil {
+		// partly written record is cut off, so the next one isn't appended after it,
+		// when it can't be the log continues in the next segment
+		if terr := l.f.Truncate(l.size); terr != nil {
+			l.closeSegment()
+		}
+		return errors.Wrap(err, "write record")
+	}
+	l.size += int64(len(packet)) + 2
+
+	if l.config.SyncInterval == 0 {
+		return errors.Wrap(l.f.Sync(), "sync segment")
+	}
+	l.dirty = true
+	return nil
+}
+
+// Close syncs written records and closes the log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	if l.config.SyncInterval > 0 {
+		close(l.quit)
+	}
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closeSegment()
+}
+
+// rotate closes current segment and creates the next one, should be called under mu
+func (l *Log) rotate() error {
+	if err := l.closeSegment(); err != nil {
+		return err
+	}
+
+	// the segment may be created by another process writing the same directory
+	for {
+		l.index++
+		f, err := os.OpenFile(segmentPath(l.dir, l.index), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "create segment")
+		}
+		l.f, l.size = f, 0
+		l.removeOld()
+		return nil
+	}
+}
+
+// removeOld removes the oldest segments exceeding MaxSegments. Segments which can't be removed
+// are tried again on the next rotation.
+func (l *Log) removeOld() {
+	if l.config.MaxSegments <= 0 {
+		return
+	}
+	indexes, err := segments(l.dir)
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(indexes)-l.config.MaxSegments; i++ {
+		os.Remove(segmentPath(l.dir, indexes[i]))
+	}
+}
+
+// closeSegment syncs and closes current segment, should be called under mu
+func (l *Log) closeSegment() error {
+	if l.f == nil {
+		return nil
+	}
+	f := l.f
+	l.f, l.dirty = nil, false
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync segment")
+	}
+	return errors.Wrap(f.Close(), "close segment")
+}
+
+// syncLoop syncs written records once in SyncInterval
+func (l *Log) syncLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.config.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.dirty {
+				if err := l.f.Sync(); err == nil {
+					l.dirty = false
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func segmentPath(dir string, index uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", index, segmentExt))
+}
+
+// segments returns sorted numbers of segments in the directory
+func segments(dir string) ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "list segments")
+	}
+
+	indexes := make([]uint64, 0, len(paths))
+	for _, path := range paths {
+		index, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			continue // not a segment
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes, nil
+}
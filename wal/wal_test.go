@@ -0,0 +1,148 @@
+package wal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/timsolov/fragmented-tcp/protocols/lowproto"
+)
+
+func readAll(t *testing.T, dir string) []string {
+	var texts []string
+	err := Read(dir, func(r Record) error {
+		texts = append(texts, r.Text)
+		return nil
+	})
+	assert.NoError(t, err)
+	return texts
+}
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, SegmentSize(200), SyncInterval(0))
+	assert.NoError(t, err)
+
+	texts := []string{"one", "two", "three", "four", "five"}
+	for i, text := range texts {
+		err := l.Append(Record{Type: RecordMsg, ID: uint64(i + 1), Time: time.Now(), From: "alice", To: "bob", Text: text})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, l.Close())
+	assert.Equal(t, ErrClosed, l.Append(Record{Type: RecordHi, Name: "alice"}))
+
+	// records don't fit into one segment
+	indexes, err := segments(dir)
+	assert.NoError(t, err)
+	assert.True(t, len(indexes) > 1)
+	assert.Equal(t, texts, readAll(t, dir))
+
+	// truncated record at the end of segment is skipped
+	last := segmentPath(dir, indexes[len(indexes)-1])
+	info, err := os.Stat(last)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(last, info.Size()-1))
+	assert.Equal(t, texts[:len(texts)-1], readAll(t, dir))
+
+	// reopened log continues in new segment
+	l, err = Open(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Append(Record{Type: RecordMsg, Time: time.Now(), Text: "six"}))
+	assert.NoError(t, l.Close())
+	assert.Equal(t, []string{"one", "two", "three", "four", "six"}, readAll(t, dir))
+
+	// files which aren't segments are ignored
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.wal"), []byte("garbage"), 0644))
+	assert.Equal(t, []string{"one", "two", "three", "four", "six"}, readAll(t, dir))
+
+	// corrupted record is skipped
+	indexes, err = segments(dir)
+	assert.NoError(t, err)
+	f, err := os.OpenFile(segmentPath(dir, indexes[0]), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	assert.NoError(t, lowproto.WriteFrame(f, []byte(`{"type":`)))
+	assert.NoError(t, f.Close())
+	assert.Equal(t, []string{"one", "two", "three", "four", "six"}, readAll(t, dir))
+}
+
+func TestLog_WriteError(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, SyncInterval(0))
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.NoError(t, l.Append(Record{Type: RecordMsg, Time: time.Now(), Text: "one"}))
+
+	// the record isn't written to segment which can't be written anymore
+	ro, err := os.Open(l.f.Name())
+	assert.NoError(t, err)
+	l.f.Close()
+	l.f = ro
+	assert.Error(t, l.Append(Record{Type: RecordMsg, Time: time.Now(), Text: "two"}))
+
+	// the log continues in the next segment
+	assert.NoError(t, l.Append(Record{Type: RecordMsg, Time: time.Now(), Text: "three"}))
+	indexes, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Len(t, indexes, 2)
+	assert.Equal(t, []string{"one", "three"}, readAll(t, dir))
+}
+
+func TestLog_MaxSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, SegmentSize(100), SyncInterval(-1), MaxSegments(2))
+	assert.NoError(t, err)
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		assert.NoError(t, l.Append(Record{Type: RecordMsg, Time: time.Now(), From: "alice", To: "bob", Text: text}))
+	}
+	assert.NoError(t, l.Close())
+
+	// every record takes its own segment, the oldest ones are removed
+	indexes, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4, 5}, indexes)
+	assert.Equal(t, []string{"four", "five"}, readAll(t, dir))
+}
+
+func TestFollow(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir, SegmentSize(100), SyncInterval(-1))
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.NoError(t, l.Append(Record{Type: RecordHi, Time: time.Now(), Name: "alice"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	records := make(chan Record)
+	done := make(chan error)
+	go func() {
+		done <- Follow(ctx, dir, func(r Record) error {
+			records <- r
+			return nil
+		})
+	}()
+
+	next := func() Record {
+		select {
+		case r := <-records:
+			return r
+		case <-time.After(time.Second * 2):
+			t.Fatal("record isn't received")
+		}
+		return Record{}
+	}
+
+	assert.Equal(t, "alice", next().Name)
+	for _, name := range []string{"bob", "carol", "dave"} {
+		assert.NoError(t, l.Append(Record{Type: RecordHi, Time: time.Now(), Name: name}))
+		assert.Equal(t, name, next().Name)
+	}
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}